@@ -0,0 +1,238 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"metrics/models"
+)
+
+var ErrNoMatch = errors.New("not_an_access_log")
+
+// CombinedFormat is nginx's predefined "combined" log_format.
+const CombinedFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+var Combined = MustCompile(CombinedFormat)
+
+// Format is a compiled nginx log_format template.
+type Format struct {
+	template string
+	re       *regexp.Regexp
+	vars     []string
+}
+
+// Well-known variables get a tight pattern so that adjacent fields split
+// correctly; anything else matches lazily up to the next literal.
+var varPatterns = map[string]string{
+	"remote_addr":            `\S+`,
+	"remote_user":            `\S+`,
+	"time_local":             `[^\]]+`,
+	"time_iso8601":           `\S+`,
+	"msec":                   `\d+(?:\.\d+)?`,
+	"request":                `[^"]*`,
+	"request_method":         `[A-Z]+`,
+	"request_uri":            `\S+`,
+	"uri":                    `\S+`,
+	"args":                   `\S*`,
+	"query_string":           `\S*`,
+	"server_protocol":        `\S+`,
+	"scheme":                 `[a-z]+`,
+	"host":                   `\S+`,
+	"http_host":              `\S+`,
+	"server_name":            `\S+`,
+	"status":                 `\d{3}`,
+	"body_bytes_sent":        `\d+|-`,
+	"bytes_sent":             `\d+|-`,
+	"request_length":         `\d+|-`,
+	"request_time":           `\d+(?:\.\d+)?|-`,
+	"upstream_response_time": `[\d.,: ]+?|-`,
+	"request_id":             `\S+`,
+}
+
+var numericVars = map[string]bool{
+	"body_bytes_sent": true,
+	"bytes_sent":      true,
+	"request_length":  true,
+}
+
+// consumedVars are mapped onto typed Log fields and left out of Data.
+var consumedVars = map[string]bool{
+	"time_local": true, "time_iso8601": true, "msec": true,
+	"request": true, "request_method": true, "request_uri": true, "uri": true, "args": true, "query_string": true,
+	"scheme": true, "host": true, "http_host": true, "server_name": true,
+	"status": true, "request_time": true,
+}
+
+var varName = regexp.MustCompile(`\$(\{[a-z0-9_]+\}|[a-z0-9_]+)`)
+
+// Compile turns a log_format template such as CombinedFormat into a parser.
+func Compile(template string) (*Format, error) {
+	f := &Format{template: template}
+
+	var b strings.Builder
+	b.WriteString(`^`)
+	last := 0
+	for _, loc := range varName.FindAllStringSubmatchIndex(template, -1) {
+		b.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		name := strings.Trim(template[loc[2]:loc[3]], "{}")
+		pattern, ok := varPatterns[name]
+		if !ok {
+			pattern = `.*?`
+		}
+		b.WriteString(`(` + pattern + `)`)
+		f.vars = append(f.vars, name)
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(template[last:]))
+	b.WriteString(`$`)
+
+	if !f.has("status") || !f.has("time_local", "time_iso8601", "msec") || !f.has("request", "request_uri", "uri") {
+		return nil, errors.New("log_format needs $status, a time variable and $request or $request_uri")
+	}
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("log_format: %w", err)
+	}
+	f.re = re
+	return f, nil
+}
+
+func MustCompile(template string) *Format {
+	f, err := Compile(template)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f *Format) has(names ...string) bool {
+	for _, v := range f.vars {
+		for _, n := range names {
+			if v == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parse converts one access-log line. When the format carries the host, Path
+// is the full scheme://host/uri URL the nginx logger sends; otherwise it is
+// just the request URI. $request_time becomes Took in milliseconds.
+func (f *Format) Parse(line string) (models.Log, error) {
+	m := f.re.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		return models.Log{}, ErrNoMatch
+	}
+	vals := make(map[string]string, len(f.vars))
+	for i, name := range f.vars {
+		vals[name] = m[i+1]
+	}
+
+	l := models.Log{Data: map[string]interface{}{}}
+
+	switch {
+	case vals["msec"] != "":
+		sec, err := strconv.ParseFloat(vals["msec"], 64)
+		if err != nil {
+			return models.Log{}, ErrNoMatch
+		}
+		l.Timestamp = time.UnixMilli(int64(math.Round(sec * 1000))).UTC()
+	case vals["time_iso8601"] != "":
+		ts, err := time.Parse(time.RFC3339, vals["time_iso8601"])
+		if err != nil {
+			return models.Log{}, ErrNoMatch
+		}
+		l.Timestamp = ts.UTC()
+	default:
+		ts, err := time.Parse("02/Jan/2006:15:04:05 -0700", vals["time_local"])
+		if err != nil {
+			return models.Log{}, ErrNoMatch
+		}
+		l.Timestamp = ts.UTC()
+	}
+
+	status, err := strconv.Atoi(vals["status"])
+	if err != nil {
+		return models.Log{}, ErrNoMatch
+	}
+	l.Status = status
+
+	uri := vals["request_uri"]
+	l.Method = vals["request_method"]
+	if req := vals["request"]; req != "" {
+		parts := strings.Fields(req)
+		if len(parts) >= 2 {
+			l.Method = parts[0]
+			if uri == "" {
+				uri = parts[1]
+			}
+		}
+		if len(parts) == 3 {
+			l.Data["server_protocol"] = parts[2]
+		}
+	}
+	if uri == "" && vals["uri"] != "" {
+		uri = vals["uri"]
+		if q := firstOf(vals, "args", "query_string"); q != "" && q != "-" {
+			uri += "?" + q
+		}
+	}
+	if l.Method == "" || uri == "" {
+		return models.Log{}, ErrNoMatch
+	}
+
+	l.Path = uri
+	if host := firstOf(vals, "host", "http_host", "server_name"); host != "-" {
+		l.Path = WithHost(uri, vals["scheme"], host)
+	}
+
+	if rt := vals["request_time"]; rt != "" && rt != "-" {
+		if sec, err := strconv.ParseFloat(rt, 64); err == nil {
+			l.Took = int(math.Round(sec * 1000))
+		}
+	}
+
+	for name, v := range vals {
+		if consumedVars[name] || v == "" || v == "-" {
+			continue
+		}
+		if numericVars[name] {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				l.Data[name] = n
+				continue
+			}
+		}
+		l.Data[name] = v
+	}
+
+	return l, nil
+}
+
+// WithHost returns the URL form of a bare request URI, for formats that do
+// not log the host.
+func WithHost(path, scheme, host string) string {
+	if host == "" || !strings.HasPrefix(path, "/") {
+		return path
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return (&url.URL{Scheme: scheme, Host: host}).String() + path
+}
+
+func firstOf(vals map[string]string, names ...string) string {
+	for _, n := range names {
+		if v := vals[n]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
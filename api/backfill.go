@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"metrics/accesslog"
+	"metrics/ingest"
+	"metrics/models"
+	"metrics/redact"
+	"metrics/routes"
+	"metrics/sampling"
+)
+
+// runBackfill imports nginx access logs from disk:
+//
+//	api backfill [-format combined|'<log_format>'] [-host h] [-scheme s] file.log [file.log.gz ...]
+//
+// Every line gets a req_id derived from its content, so re-running over the
+// same files only produces duplicates against the unique req_id index.
+func runBackfill(args []string) int {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	format := fs.String("format", "combined", `"combined" or an nginx log_format template`)
+	host := fs.String("host", "", "host to prefix paths with when the format does not log it")
+	scheme := fs.String("scheme", "https", "scheme used together with -host")
+	source := fs.String("source", "backfill", "source recorded on imported logs")
+	batchSize := fs.Int("batch", 1000, "logs per insert")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: backfill [flags] file... (use - for stdin)")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	f := accesslog.Combined
+	if *format != "combined" {
+		var err error
+		if f, err = accesslog.Compile(*format); err != nil {
+			log.Printf("backfill: %v", err)
+			return 2
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	disconnect, ok := commandStorage(ctx)
+	if !ok {
+		return 1
+	}
+	defer disconnect()
+
+	redactCfg, err := redact.LoadConfig(os.Getenv("REDACT_CONFIG"))
+	if err == nil {
+		err = redact.Configure(redactCfg)
+	}
+	if err != nil {
+		log.Printf("redact config: %v", err)
+		return 1
+	}
+
+	samplingCfg, err := sampling.LoadConfig(os.Getenv("SAMPLING_CONFIG"))
+	if err == nil {
+		err = sampling.Configure(samplingCfg)
+	}
+	if err != nil {
+		log.Printf("sampling config: %v", err)
+		return 1
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	err = routes.Load(lctx)
+	cancel()
+	if err != nil {
+		log.Printf("route templates: %v", err)
+		return 1
+	}
+
+	b := &backfill{format: f, host: *host, scheme: *scheme, source: *source, batchSize: *batchSize}
+	if b.batchSize <= 0 {
+		b.batchSize = 1000
+	}
+	for _, name := range fs.Args() {
+		if err := b.file(ctx, name); err != nil {
+			log.Printf("backfill %s: %v", name, err)
+			return 1
+		}
+	}
+	log.Printf("backfill: %d lines, %d inserted, %d duplicates, %d sampled out, %d skipped, %d failed",
+		b.lines, b.inserted, b.duplicates, b.sampled, b.skipped, b.failed)
+	if b.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type backfill struct {
+	format    *accesslog.Format
+	host      string
+	scheme    string
+	source    string
+	batchSize int
+
+	batch []models.Log
+
+	// identical lines within the same second are legitimate (a client
+	// retrying quickly), so the occurrence count is part of the req_id
+	seen   map[string]int
+	seenAt time.Time
+
+	lines, inserted, duplicates, sampled, skipped, failed int
+	reported                                              int
+}
+
+func (b *backfill) file(ctx context.Context, name string) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReaderSize(zr, 64<<10)
+	}
+
+	sc := bufio.NewScanner(br)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.lines++
+
+		line := sc.Text()
+		l, err := b.format.Parse(line)
+		if err != nil {
+			if line != "" {
+				b.skipped++
+				if b.skipped <= 10 {
+					log.Printf("backfill %s:%d: %v", name, lineNo, err)
+				}
+			}
+			continue
+		}
+		l.ReqID = b.reqID(line, l.Timestamp)
+		l.Source = b.source
+		if b.host != "" {
+			l.Path = accesslog.WithHost(l.Path, b.scheme, b.host)
+		}
+
+		b.batch = append(b.batch, l)
+		if len(b.batch) >= b.batchSize {
+			if err := b.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return b.flush(ctx)
+}
+
+func (b *backfill) reqID(line string, ts time.Time) string {
+	if !ts.Equal(b.seenAt) {
+		b.seen = map[string]int{}
+		b.seenAt = ts
+	}
+	n := b.seen[line]
+	b.seen[line] = n + 1
+
+	sum := sha256.Sum256([]byte(line + "\x00" + strconv.Itoa(n)))
+	return "bf-" + hex.EncodeToString(sum[:16])
+}
+
+func (b *backfill) flush(ctx context.Context) error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	kept, _ := ingest.Prepare(b.batch)
+	b.sampled += len(b.batch) - len(kept)
+
+	wctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	res, err := ingest.Insert(wctx, kept)
+	if err != nil {
+		return err
+	}
+	b.inserted += res.Inserted
+	b.duplicates += len(res.Duplicates)
+	b.failed += len(res.Failed)
+	for i, e := range res.Failed {
+		log.Printf("backfill: %s: %v", kept[i].ReqID, e)
+	}
+
+	if b.lines-b.reported >= 100000 {
+		b.reported = b.lines
+		log.Printf("backfill: %d lines, %d inserted, %d duplicates", b.lines, b.inserted, b.duplicates)
+	}
+	b.batch = b.batch[:0]
+	return nil
+}
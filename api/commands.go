@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"metrics/storage"
+)
+
+// Maintenance commands share the binary with the server: `api <command> ...`.
+var commands = map[string]func(args []string) int{
+	"backfill":        runBackfill,
+	"migrate-urls":    runMigrateURLs,
+	"index-search":    runIndexSearch,
+	"rebuild-rollups": runRebuildRollups,
+}
+
+// commandStorage connects and ensures indexes for a command. The returned
+// func disconnects.
+func commandStorage(ctx context.Context) (func(), bool) {
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := storage.Connect(connectCtx); err != nil {
+		log.Printf("mongo connect: %v", err)
+		return nil, false
+	}
+	if err := storage.EnsureIndexes(connectCtx); err != nil {
+		storage.Disconnect(context.Background())
+		log.Printf("mongo indexes: %v", err)
+		return nil, false
+	}
+	return func() { storage.Disconnect(context.Background()) }, true
+}
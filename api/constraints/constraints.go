@@ -2,3 +2,5 @@ package constraints
 
 const DevSecret = "dev-secret-change-me"
 const Authorization = "Authorization"
+const IngestKey = "X-Ingest-Key"
+const NDJSON = "application/x-ndjson"
@@ -0,0 +1,170 @@
+// Package export streams stored documents as CSV, NDJSON or Parquet. Nested
+// fields are flattened into dotted column names such as
+// download.latency.iqm, so every format has the same flat shape.
+package export
+
+import (
+	"strings"
+
+	"metrics/logquery"
+)
+
+// Kind is the type a column is written as.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindFloat
+	KindBool
+	KindTime
+	// KindAny keeps whatever is stored; Parquet and CSV write non-strings as
+	// JSON text.
+	KindAny
+)
+
+// Column maps an exported column to its stored field.
+type Column struct {
+	Name  string // as in the JSON API
+	Field string // dotted BSON path
+	Kind  Kind
+}
+
+// Catalog is the set of columns an export offers, in their default order.
+type Catalog struct {
+	Columns []Column
+	// Data allows a data column, the whole document as JSON text, and
+	// data.<path> columns on top of the catalog. None of them is selected by
+	// default; data can be large enough to make every row a big one.
+	Data bool
+}
+
+const maxColumns = 100
+
+// ColumnError names the column that could not be selected.
+type ColumnError struct {
+	Column string
+}
+
+func (e *ColumnError) Error() string { return "export: unknown column " + e.Column }
+
+// Select resolves a comma-separated column list. An empty list selects the
+// whole catalog. A name that prefixes catalog columns, such as "download",
+// selects all of them.
+func (cat Catalog) Select(list string) ([]Column, error) {
+	if strings.TrimSpace(list) == "" {
+		return cat.Columns, nil
+	}
+
+	var out []Column
+	seen := map[string]bool{}
+	add := func(c Column) {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			out = append(out, c)
+		}
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, c := range cat.Columns {
+			if c.Name == name || strings.HasPrefix(c.Name, name+".") {
+				add(c)
+				found = true
+			}
+		}
+		if !found && cat.Data && name == "data" {
+			add(Column{Name: name, Field: name, Kind: KindString})
+			found = true
+		}
+		if !found && cat.Data && logquery.ValidDataField(name) {
+			add(Column{Name: name, Field: name, Kind: KindAny})
+			found = true
+		}
+		if !found {
+			return nil, &ColumnError{Column: name}
+		}
+	}
+	if len(out) > maxColumns {
+		return nil, &ColumnError{Column: out[maxColumns].Name}
+	}
+	return out, nil
+}
+
+// Fields lists the stored fields the columns read, for a projection.
+func Fields(cols []Column) []string {
+	out := make([]string, len(cols))
+	for i, c := range cols {
+		out[i] = c.Field
+	}
+	return out
+}
+
+var Logs = Catalog{
+	Data: true,
+	Columns: []Column{
+		{"req_id", "req_id", KindString},
+		{"timestamp", "timestamp", KindTime},
+		{"status", "status", KindInt},
+		{"took", "took", KindInt},
+		{"method", "method", KindString},
+		{"path", "path", KindString},
+		{"host", "host", KindString},
+		{"scheme", "scheme", KindString},
+		{"pathname", "pathname", KindString},
+		{"query", "query", KindString},
+		{"route", "route", KindString},
+		{"sample_rate", "sample_rate", KindFloat},
+		{"parent_id", "parent_id", KindString},
+		{"trace_id", "trace_id", KindString},
+		{"source", "source", KindString},
+	},
+}
+
+// Speedtests follows models.Speedtest. Fields without a bson tag are stored
+// under their lower-cased Go name.
+var Speedtests = Catalog{
+	Columns: []Column{
+		{"timestamp", "timestamp", KindTime},
+		{"type", "type", KindString},
+		{"isp", "isp", KindString},
+		{"packetLoss", "packetloss", KindFloat},
+		{"ping.latency", "ping.latency", KindFloat},
+		{"ping.jitter", "ping.jitter", KindFloat},
+		{"ping.low", "ping.low", KindFloat},
+		{"ping.high", "ping.high", KindFloat},
+		{"download.bandwidth", "download.bandwidth", KindInt},
+		{"download.bytes", "download.bytes", KindInt},
+		{"download.elapsed", "download.elapsed", KindInt},
+		{"download.latency.iqm", "download.latency.iqm", KindFloat},
+		{"download.latency.low", "download.latency.low", KindFloat},
+		{"download.latency.high", "download.latency.high", KindFloat},
+		{"download.latency.jitter", "download.latency.jitter", KindFloat},
+		{"upload.bandwidth", "upload.bandwidth", KindInt},
+		{"upload.bytes", "upload.bytes", KindInt},
+		{"upload.elapsed", "upload.elapsed", KindInt},
+		{"upload.latency.iqm", "upload.latency.iqm", KindFloat},
+		{"upload.latency.low", "upload.latency.low", KindFloat},
+		{"upload.latency.high", "upload.latency.high", KindFloat},
+		{"upload.latency.jitter", "upload.latency.jitter", KindFloat},
+		{"interface.name", "interface.name", KindString},
+		{"interface.internalIp", "interface.internalIp", KindString},
+		{"interface.externalIp", "interface.externalIp", KindString},
+		{"interface.macAddr", "interface.macAddr", KindString},
+		{"interface.isVpn", "interface.isVpn", KindBool},
+		{"server.id", "server.id", KindInt},
+		{"server.name", "server.name", KindString},
+		{"server.location", "server.location", KindString},
+		{"server.country", "server.country", KindString},
+		{"server.host", "server.host", KindString},
+		{"server.port", "server.port", KindInt},
+		{"server.ip", "server.ip", KindString},
+		{"result.id", "result.id", KindString},
+		{"result.url", "result.url", KindString},
+		{"result.persisted", "result.persisted", KindBool},
+		{"source", "source", KindString},
+	},
+}
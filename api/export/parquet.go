@@ -0,0 +1,107 @@
+package export
+
+import (
+	"bufio"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// A row group is held in memory until it is flushed, after this many rows
+// or once the values buffered for it add up to parquetGroupBytes.
+const (
+	parquetRowGroup   = 50000
+	parquetGroupBytes = 64 << 20
+)
+
+type parquetWriter struct {
+	bw    *bufio.Writer
+	w     *parquet.Writer
+	index []int // column position in the schema, which orders by name
+	kinds []Kind
+	row   parquet.Row
+	rows  int
+	bytes int // buffered for the current row group
+}
+
+func newParquetWriter(bw *bufio.Writer, cols []Column) *parquetWriter {
+	group := parquet.Group{}
+	for _, c := range cols {
+		group[c.Name] = parquet.Optional(parquetNode(c.Kind))
+	}
+	schema := parquet.NewSchema("export", group)
+
+	pw := &parquetWriter{
+		bw:    bw,
+		w:     parquet.NewWriter(bw, schema, parquet.Compression(&parquet.Zstd)),
+		index: make([]int, len(cols)),
+		kinds: make([]Kind, len(cols)),
+		row:   make(parquet.Row, len(cols)),
+	}
+	for i, c := range cols {
+		leaf, _ := schema.Lookup(c.Name)
+		pw.index[i] = leaf.ColumnIndex
+		pw.kinds[i] = c.Kind
+	}
+	return pw
+}
+
+func parquetNode(k Kind) parquet.Node {
+	switch k {
+	case KindInt:
+		return parquet.Int(64)
+	case KindFloat:
+		return parquet.Leaf(parquet.DoubleType)
+	case KindBool:
+		return parquet.Leaf(parquet.BooleanType)
+	case KindTime:
+		return parquet.Timestamp(parquet.Millisecond)
+	}
+	return parquet.String()
+}
+
+func (pw *parquetWriter) Write(row []interface{}) error {
+	for i, v := range row {
+		idx := pw.index[i]
+		if v == nil {
+			pw.row[idx] = parquet.NullValue().Level(0, 0, idx)
+			continue
+		}
+		// Row has already coerced v to the column kind
+		var pv parquet.Value
+		switch pw.kinds[i] {
+		case KindInt:
+			pv = parquet.Int64Value(v.(int64))
+		case KindFloat:
+			pv = parquet.DoubleValue(v.(float64))
+		case KindBool:
+			pv = parquet.BooleanValue(v.(bool))
+		case KindTime:
+			pv = parquet.Int64Value(v.(time.Time).UnixMilli())
+		default:
+			pv = parquet.ByteArrayValue([]byte(text(v)))
+		}
+		pw.row[idx] = pv.Level(0, 1, idx)
+		if pv.Kind() == parquet.ByteArray {
+			pw.bytes += len(pv.ByteArray())
+		} else {
+			pw.bytes += 8
+		}
+	}
+	if _, err := pw.w.WriteRows([]parquet.Row{pw.row}); err != nil {
+		return err
+	}
+	pw.rows++
+	if pw.rows >= parquetRowGroup || pw.bytes >= parquetGroupBytes {
+		pw.rows, pw.bytes = 0, 0
+		return pw.w.Flush()
+	}
+	return nil
+}
+
+func (pw *parquetWriter) Close() error {
+	if err := pw.w.Close(); err != nil {
+		return err
+	}
+	return pw.bw.Flush()
+}
@@ -0,0 +1,106 @@
+package export
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Row reads the columns out of a stored document. A value is nil when the
+// field is missing or cannot be read as the column's kind; otherwise it is a
+// string, int64, float64, bool or time.Time, or for KindAny any plain JSON
+// value.
+func Row(doc bson.Raw, cols []Column, row []interface{}) []interface{} {
+	row = row[:0]
+	for _, c := range cols {
+		rv, err := doc.LookupErr(strings.Split(c.Field, ".")...)
+		if err != nil || rv.Type == bsontype.Null || rv.Type == bsontype.Undefined {
+			row = append(row, nil)
+			continue
+		}
+		row = append(row, value(rv, c.Kind))
+	}
+	return row
+}
+
+func value(rv bson.RawValue, k Kind) interface{} {
+	switch k {
+	case KindInt:
+		if n, ok := rv.AsInt64OK(); ok {
+			return n
+		}
+		return nil
+	case KindFloat:
+		if f, ok := rv.DoubleOK(); ok {
+			return f
+		}
+		if n, ok := rv.AsInt64OK(); ok {
+			return float64(n)
+		}
+		return nil
+	case KindBool:
+		if b, ok := rv.BooleanOK(); ok {
+			return b
+		}
+		return nil
+	case KindTime:
+		if ms, ok := rv.DateTimeOK(); ok {
+			return time.UnixMilli(ms).UTC()
+		}
+		return nil
+	case KindString:
+		if s, ok := rv.StringValueOK(); ok {
+			return s
+		}
+		// nested documents and arrays end up as JSON text
+		b, err := json.Marshal(plainValue(rv))
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+	return plainValue(rv)
+}
+
+func plainValue(rv bson.RawValue) interface{} {
+	var v interface{}
+	if err := rv.Unmarshal(&v); err != nil {
+		return nil
+	}
+	return plain(v)
+}
+
+// plain turns decoded BSON into values encoding/json renders naturally.
+func plain(v interface{}) interface{} {
+	switch x := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(x))
+		for _, e := range x {
+			m[e.Key] = plain(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[k] = plain(e)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(x))
+		for i, e := range x {
+			a[i] = plain(e)
+		}
+		return a
+	case primitive.DateTime:
+		return x.Time().UTC()
+	case primitive.ObjectID:
+		return x.Hex()
+	case int32:
+		return int64(x)
+	}
+	return v
+}
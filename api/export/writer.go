@@ -0,0 +1,153 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+var ErrUnknownFormat = errors.New("unknown_format")
+
+// Writer encodes rows produced by Row. Close must be called to flush the
+// output; for Parquet it also writes the footer.
+type Writer interface {
+	Write(row []interface{}) error
+	Close() error
+}
+
+// ContentType returns the media type and file extension of a format.
+func ContentType(format string) (string, string, error) {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8", "csv", nil
+	case FormatNDJSON:
+		return "application/x-ndjson", "ndjson", nil
+	case FormatParquet:
+		return "application/vnd.apache.parquet", "parquet", nil
+	}
+	return "", "", ErrUnknownFormat
+}
+
+// NewWriter starts an export of cols to w.
+func NewWriter(format string, w io.Writer, cols []Column) (Writer, error) {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(bw, cols)
+	case FormatNDJSON:
+		return newNDJSONWriter(bw, cols), nil
+	case FormatParquet:
+		return newParquetWriter(bw, cols), nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+type csvWriter struct {
+	bw     *bufio.Writer
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVWriter(bw *bufio.Writer, cols []Column) (*csvWriter, error) {
+	cw := &csvWriter{bw: bw, w: csv.NewWriter(bw), record: make([]string, len(cols))}
+	for i, c := range cols {
+		cw.record[i] = c.Name
+	}
+	return cw, cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Write(row []interface{}) error {
+	for i, v := range row {
+		cw.record[i] = text(v)
+		if _, ok := v.(string); ok && formula(cw.record[i]) {
+			// spreadsheets would evaluate it; the quote makes it plain text
+			cw.record[i] = "'" + cw.record[i]
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+// formula reports whether a spreadsheet would read s as a formula.
+func formula(s string) bool {
+	return s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0]))
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		return err
+	}
+	return cw.bw.Flush()
+}
+
+// text renders a value for CSV and for Parquet columns of KindAny.
+func text(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// ndjsonWriter writes one flat object per line with the keys in column
+// order.
+type ndjsonWriter struct {
+	bw   *bufio.Writer
+	keys [][]byte
+}
+
+func newNDJSONWriter(bw *bufio.Writer, cols []Column) *ndjsonWriter {
+	nw := &ndjsonWriter{bw: bw, keys: make([][]byte, len(cols))}
+	for i, c := range cols {
+		k, _ := json.Marshal(c.Name)
+		nw.keys[i] = append(k, ':')
+	}
+	return nw
+}
+
+func (nw *ndjsonWriter) Write(row []interface{}) error {
+	nw.bw.WriteByte('{')
+	for i, v := range row {
+		if i > 0 {
+			nw.bw.WriteByte(',')
+		}
+		nw.bw.Write(nw.keys[i])
+		b, err := json.Marshal(v)
+		if err != nil {
+			b = []byte("null")
+		}
+		nw.bw.Write(b)
+	}
+	nw.bw.WriteByte('}')
+	_, err := nw.bw.WriteString("\n")
+	return err
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nw.bw.Flush()
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"metrics/models"
+	"metrics/redact"
+	"metrics/storage"
+	"metrics/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// payloads beyond this are stored cut and cannot be resubmitted as-is
+var deadLetterMaxPayload = utils.EnvInt("DEADLETTER_MAX_PAYLOAD_BYTES", 64<<10)
+
+// deadLetter keeps a rejected payload. It is written in the background so
+// that a struggling database does not slow down the 400 going back to the
+// client.
+func deadLetter(c *gin.Context, kind, reason string, errs []string, payload []byte) {
+	d := models.DeadLetter{
+		Kind:        kind,
+		Reason:      reason,
+		Errors:      errs,
+		ContentType: c.ContentType(),
+		Size:        len(payload),
+		IP:          c.ClientIP(),
+		ReceivedAt:  time.Now().UTC(),
+	}
+	// masked before it is cut, so the JSON still decodes for the key rules
+	text := redact.Payload(strings.ToValidUTF8(string(payload), string(utf8.RuneError)))
+	if len(text) > deadLetterMaxPayload {
+		text = strings.ToValidUTF8(text[:deadLetterMaxPayload], "")
+		d.Truncated = true
+	}
+	d.Payload = text
+	if v, ok := c.Get("ingest_key"); ok {
+		if k, ok := v.(models.IngestKey); ok {
+			d.IngestKeyID = &k.ID
+			d.Source = k.Source
+		}
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := storage.DeadLetterInsert(ctx, &d); err != nil {
+			log.Printf("deadletter: %s %s: %v", d.Kind, d.Reason, err)
+		}
+	}()
+}
+
+// deadLetterInvalidLogs keeps the entries of a log batch that failed
+// validation, as a JSON array of the original items.
+func deadLetterInvalidLogs(c *gin.Context, body []byte, items []models.LogItemResult) {
+	var raw []json.RawMessage
+	if json.Unmarshal(body, &raw) != nil {
+		raw = []json.RawMessage{body}
+	}
+
+	var (
+		kept   = make([]json.RawMessage, 0)
+		errs   = make([]string, 0)
+		reason string
+	)
+	for _, it := range items {
+		if it.Status != models.LogItemInvalid || it.Index >= len(raw) {
+			continue
+		}
+		if reason == "" {
+			reason = it.Error
+		}
+		kept = append(kept, raw[it.Index])
+		errs = append(errs, fmt.Sprintf("index %d: %s", it.Index, it.Error))
+	}
+	if len(kept) == 0 {
+		return
+	}
+	payload, _ := json.Marshal(kept)
+	deadLetter(c, models.DeadLetterLogs, reason, errs, payload)
+}
+
+func DeadLetterList(c *gin.Context) {
+	from, to, limit, skip, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return
+	}
+	kind := c.Query("kind")
+	if kind != "" && kind != models.DeadLetterLogs && kind != models.DeadLetterSpeedtest {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_kind"})
+		return
+	}
+
+	items, err := storage.DeadLetterQuery(c.Request.Context(), from, to, kind, c.Query("reason"), limit, skip)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func DeadLetterGet(c *gin.Context) {
+	d, ok := deadLetterByParam(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func DeadLetterDelete(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_id"})
+		return
+	}
+	if err := storage.DeadLetterDelete(c.Request.Context(), id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_delete_failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// DeadLetterResubmit runs a dead letter through ingestion again, under the
+// source it was received with. A corrected payload may be sent as the body;
+// without one the stored payload is used, which is refused when it was cut.
+// Logs are masked again by ingest.Prepare like any batch; values the letter
+// was stored with already hashed are left as they are.
+func DeadLetterResubmit(c *gin.Context) {
+	d, ok := deadLetterByParam(c)
+	if !ok {
+		return
+	}
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "read_failed"})
+		return
+	}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		if d.Truncated {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "payload_truncated"})
+			return
+		}
+		payload = []byte(d.Payload)
+	}
+
+	var (
+		status int
+		result interface{}
+	)
+	switch d.Kind {
+	case models.DeadLetterLogs:
+		var (
+			batch   []models.Log
+			invalid []error
+		)
+		if d.ContentType == ndjsonContentType {
+			batch, invalid = logsFromNDJSON(payload)
+		} else if batch, invalid, err = models.LogsFromJSON(payload); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(batch) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "empty_body"})
+			return
+		}
+		resp, err := acceptLogs(c, d.Source, batch, invalid)
+		if err != nil {
+			abortAccept(c, err)
+			return
+		}
+		status, result = resp.httpStatus(), resp
+	case models.DeadLetterSpeedtest:
+		var in models.Speedtest
+		if err := binding.JSON.BindBody(payload, &in); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		now := time.Now().UTC()
+		in.ReceivedAt = &now
+		in.Source = d.Source
+		if err := storage.SpeedtestInsertIdempotent(c.Request.Context(), &in); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed"})
+			return
+		}
+		status, result = http.StatusCreated, true
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_kind"})
+		return
+	}
+
+	if status < http.StatusBadRequest {
+		u, _ := c.MustGet("user").(models.User)
+		if err := storage.DeadLetterMarkResubmitted(c.Request.Context(), d.ID, u.ID, time.Now().UTC()); err != nil {
+			log.Printf("deadletter: mark %s resubmitted: %v", d.ID.Hex(), err)
+		}
+	}
+	c.JSON(status, result)
+}
+
+// logsFromNDJSON decodes the stored lines of an NDJSON dead letter; lines
+// that still fail keep their error at the same index.
+func logsFromNDJSON(payload []byte) ([]models.Log, []error) {
+	var (
+		batch   []models.Log
+		invalid []error
+	)
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		l, err := models.LogFromJSON(line)
+		batch = append(batch, l)
+		invalid = append(invalid, err)
+	}
+	return batch, invalid
+}
+
+func deadLetterByParam(c *gin.Context) (*models.DeadLetter, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_id"})
+		return nil, false
+	}
+	d, err := storage.DeadLetterGet(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return nil, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return nil, false
+	}
+	return d, true
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"metrics/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func EventList(c *gin.Context) {
+	from, to, limit, skip, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return
+	}
+
+	items, err := storage.EventQuery(c.Request.Context(), from, to, limit, skip)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
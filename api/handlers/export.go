@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"metrics/export"
+	"metrics/middlewares"
+	"metrics/storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// LogExport streams the logs of a range as CSV, NDJSON or Parquet. It takes
+// the filters of LogList, plus format and columns.
+func LogExport(c *gin.Context) {
+	from, to, _, _, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return
+	}
+	filter, ok := logFilter(c)
+	if !ok {
+		return
+	}
+	cols, ok := exportColumns(c, export.Logs)
+	if !ok {
+		return
+	}
+	limit, ok := exportLimit(c)
+	if !ok {
+		return
+	}
+
+	streamExport(c, "logs", cols, func(fn func(bson.Raw) error) error {
+		return storage.LogExport(c.Request.Context(), from, to, filter, export.Fields(cols), limit, fn)
+	})
+}
+
+// SpeedtestExport streams the speedtest results of a range, with nested
+// fields flattened into columns such as download.latency.iqm.
+func SpeedtestExport(c *gin.Context) {
+	from, to, _, _, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return
+	}
+	cols, ok := exportColumns(c, export.Speedtests)
+	if !ok {
+		return
+	}
+	limit, ok := exportLimit(c)
+	if !ok {
+		return
+	}
+
+	streamExport(c, "speedtests", cols, func(fn func(bson.Raw) error) error {
+		return storage.SpeedtestExport(c.Request.Context(), from, to, export.Fields(cols), limit, fn)
+	})
+}
+
+// ---------------- Private helpers ----------------
+
+// exportColumns reads columns, or fields as on the list endpoints.
+func exportColumns(c *gin.Context, cat export.Catalog) ([]export.Column, bool) {
+	list := c.Query("columns")
+	if list == "" {
+		list = c.Query("fields")
+	}
+	cols, err := cat.Select(list)
+	if err != nil {
+		var ce *export.ColumnError
+		if errors.As(err, &ce) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_column", "column": ce.Column})
+			return nil, false
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_column"})
+		return nil, false
+	}
+	return cols, true
+}
+
+// exportLimit reads limit; unlike the list endpoints an export has no cap
+// beyond its time range.
+func exportLimit(c *gin.Context) (int64, bool) {
+	v := c.Query("limit")
+	if v == "" {
+		return -1, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_limit"})
+		return 0, false
+	}
+	return n, true
+}
+
+// streamExport writes the response outside ResponseWrapper. Once the first
+// byte is out the status cannot change, so a failure midway drops the
+// connection before the end of the chunked body: the client sees a broken
+// download rather than a short file that looks whole. The Export-Complete
+// trailer says the same to clients that read trailers.
+func streamExport(c *gin.Context, name string, cols []export.Column, run func(fn func(bson.Raw) error) error) {
+	format := c.DefaultQuery("format", export.FormatCSV)
+	contentType, ext, err := export.ContentType(format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_format"})
+		return
+	}
+
+	middlewares.StreamResponse(c)
+	filename := name + "-" + time.Now().UTC().Format("20060102T150405Z") + "." + ext
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Trailer", "Export-Complete")
+	c.Status(http.StatusOK)
+
+	w, err := export.NewWriter(format, c.Writer, cols)
+	if err != nil {
+		log.Printf("export %s: %v", name, err)
+		return
+	}
+	var row []interface{}
+	rows := 0
+	err = run(func(doc bson.Raw) error {
+		row = export.Row(doc, cols, row)
+		rows++
+		return w.Write(row)
+	})
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Printf("export %s: stopped after %d rows: %v", name, rows, err)
+		c.Writer.Header().Set("Export-Complete", "false")
+		abortResponse(c)
+		return
+	}
+	c.Writer.Header().Set("Export-Complete", "true")
+}
+
+// abortResponse closes the connection under a response in progress, so it
+// ends without its terminating chunk. HTTP/2 connections cannot be taken
+// over; there only the trailer tells.
+func abortResponse(c *gin.Context) {
+	// gin refuses to hijack once the body has started; ask the server's writer
+	var w http.ResponseWriter = c.Writer
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		w = u.Unwrap()
+	}
+	if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+		conn.Close()
+	}
+}
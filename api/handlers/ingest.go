@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"net/http"
+
+	"metrics/ingest"
+	"metrics/spool"
+
+	"github.com/gin-gonic/gin"
+)
+
+func IngestStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"queue": ingest.Stats()})
+}
+
+func IngestSpool(c *gin.Context) {
+	c.JSON(http.StatusOK, spool.GetStatus())
+}
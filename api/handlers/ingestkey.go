@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"metrics/middlewares"
+	"metrics/models"
+	"metrics/storage"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ingestKeyDTO struct {
+	Source string   `json:"source" validate:"required,max=64"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=logs speedtest"`
+}
+
+type ingestKeyCreatedResponse struct {
+	models.IngestKey
+	Key string `json:"key"`
+}
+
+func IngestKeyCreate(c *gin.Context) {
+	var payload ingestKeyDTO
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_payload"})
+		return
+	}
+	payload.Source = strings.TrimSpace(payload.Source)
+	if err := validate.Struct(payload); err != nil || payload.Source == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "validation_failed"})
+		return
+	}
+
+	secret, err := models.NewIngestKeySecret()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "key_generation_failed"})
+		return
+	}
+
+	u, _ := c.MustGet("user").(models.User)
+	k := models.IngestKey{
+		Source:    payload.Source,
+		Prefix:    models.IngestKeyDisplayPrefix(secret),
+		Hash:      models.HashIngestKey(secret),
+		Scopes:    dedupe(payload.Scopes),
+		CreatedBy: u.ID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := storage.IngestKeyCreate(ctx, &k); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ingestKeyCreatedResponse{IngestKey: k, Key: secret})
+}
+
+func IngestKeyList(c *gin.Context) {
+	items, err := storage.IngestKeyList(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func IngestKeyRevoke(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_id"})
+		return
+	}
+
+	k, err := storage.IngestKeyRevoke(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_update_failed"})
+		return
+	}
+	// refused here at once; other instances see it on their next reload
+	middlewares.CacheIngestKey(*k)
+
+	c.JSON(http.StatusOK, k)
+}
+
+// ingestSource returns the source name of the ingest key that authenticated
+// the request, or an empty string if there is none.
+func ingestSource(c *gin.Context) string {
+	v, ok := c.Get("ingest_key")
+	if !ok {
+		return ""
+	}
+	k, _ := v.(models.IngestKey)
+	return k.Source
+}
+
+func dedupe(list []string) []string {
+	seen := make(map[string]struct{}, len(list))
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
@@ -3,11 +3,15 @@ package handlers
 import (
 	"errors"
 	"io"
-	"metrics/broadcast"
+	"math"
+	"metrics/ingest"
+	"metrics/logquery"
+	"metrics/middlewares"
 	"metrics/models"
 	"metrics/storage"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,34 +19,152 @@ import (
 )
 
 func LogCreate(c *gin.Context) {
+	if c.ContentType() == ndjsonContentType {
+		logCreateNDJSON(c)
+		return
+	}
+
 	body, err := io.ReadAll(c.Request.Body)
+	if middlewares.BodyTooLarge(err) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body_too_large"})
+		return
+	}
 	if err != nil || len(body) == 0 {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "empty_body"})
 		return
 	}
 
-	batch, err := models.LogsFromJSON(body)
+	batch, invalid, err := models.LogsFromJSON(body)
 	if err != nil {
+		deadLetter(c, models.DeadLetterLogs, err.Error(), nil, body)
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := storage.LogInsert(c.Request.Context(), batch); err != nil {
-		var bwe mongo.BulkWriteException
-		var we mongo.WriteException
-		if errors.As(err, &bwe) || errors.As(err, &we) {
-			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "duplicate_req_id"})
-			return
-		}
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed"})
+	resp, err := acceptLogs(c, ingestSource(c), batch, invalid)
+	if err != nil {
+		abortAccept(c, err)
 		return
 	}
+	if resp.Invalid > 0 {
+		deadLetterInvalidLogs(c, body, resp.Items)
+	}
+
+	c.JSON(resp.httpStatus(), resp)
+}
 
+// acceptLogs stamps source on and prepares the valid entries of a decoded
+// batch and hands them to the write-behind queue, or stores them right away
+// when the queue is disabled. invalid holds per-index validation errors.
+func acceptLogs(c *gin.Context, source string, batch []models.Log, invalid []error) (logCreateResponse, error) {
+	var (
+		resp  = logCreateResponse{Items: make([]models.LogItemResult, len(batch))}
+		valid = make([]models.Log, 0, len(batch))
+		index = make([]int, 0, len(batch))
+	)
 	for i := range batch {
-		broadcast.Log(batch[i])
+		if invalid[i] != nil {
+			resp.Items[i] = models.LogItemResult{Index: i, ReqID: batch[i].ReqID, Status: models.LogItemInvalid, Error: invalid[i].Error()}
+			continue
+		}
+		batch[i].Source = source
+		valid = append(valid, batch[i])
+		index = append(index, i)
+	}
+	kept, dropped := ingest.Prepare(valid)
+	keptIndex := make([]int, 0, len(kept))
+	for j, d := range dropped {
+		i := index[j]
+		if d {
+			resp.Items[i] = models.LogItemResult{Index: i, ReqID: batch[i].ReqID, Status: models.LogItemSampled}
+			continue
+		}
+		keptIndex = append(keptIndex, i)
+	}
+	valid, index = kept, keptIndex
+
+	if ingest.Enabled() && len(valid) > 0 {
+		if err := ingest.Enqueue(valid); err != nil {
+			return resp, err
+		}
+		for _, i := range index {
+			resp.Items[i] = models.LogItemResult{Index: i, ReqID: batch[i].ReqID, Status: models.LogItemQueued}
+		}
+		resp.count()
+		return resp, nil
 	}
 
-	c.JSON(http.StatusCreated, true)
+	results, err := ingest.Store(c.Request.Context(), valid)
+	if err != nil {
+		return resp, err
+	}
+	for j, r := range results {
+		r.Index = index[j]
+		resp.Items[r.Index] = r
+	}
+	resp.count()
+	return resp, nil
+}
+
+func abortAccept(c *gin.Context, err error) {
+	if errors.Is(err, ingest.ErrQueueFull) || errors.Is(err, ingest.ErrQueueClosed) {
+		retry := int(math.Ceil(ingest.RetryAfter().Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retry))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed"})
+}
+
+type logCreateResponse struct {
+	Queued     int                    `json:"queued"`
+	Inserted   int                    `json:"inserted"`
+	Spooled    int                    `json:"spooled"`
+	Sampled    int                    `json:"sampled"`
+	Duplicates int                    `json:"duplicates"`
+	Invalid    int                    `json:"invalid"`
+	Failed     int                    `json:"failed"`
+	Items      []models.LogItemResult `json:"items"`
+}
+
+func (r *logCreateResponse) count() {
+	for _, it := range r.Items {
+		switch it.Status {
+		case models.LogItemQueued:
+			r.Queued++
+		case models.LogItemInserted:
+			r.Inserted++
+		case models.LogItemSpooled:
+			r.Spooled++
+		case models.LogItemSampled:
+			r.Sampled++
+		case models.LogItemDuplicate:
+			r.Duplicates++
+		case models.LogItemInvalid:
+			r.Invalid++
+		case models.LogItemFailed:
+			r.Failed++
+		}
+	}
+}
+
+// httpStatus is 201 when every entry is stored or already was, so replays by
+// the nginx logger look successful, and 202 when the entries were queued or
+// spooled for a later write. Write failures are worth a retry and answer 500; validation
+// problems will not go away on retry and answer 207, or 400 when nothing at
+// all was valid.
+func (r *logCreateResponse) httpStatus() int {
+	switch {
+	case r.Failed > 0:
+		return http.StatusInternalServerError
+	case r.Invalid == len(r.Items):
+		return http.StatusBadRequest
+	case r.Invalid > 0:
+		return http.StatusMultiStatus
+	case r.Queued > 0 || r.Spooled > 0:
+		return http.StatusAccepted
+	}
+	return http.StatusCreated
 }
 
 func LogList(c *gin.Context) {
@@ -51,41 +173,192 @@ func LogList(c *gin.Context) {
 		return
 	}
 
-	items, err := storage.LogQuery(c.Request.Context(), from, to, limit, skip)
+	filter, ok := logFilter(c)
+	if !ok {
+		return
+	}
+	fields, ok := logFields(c)
+	if !ok {
+		return
+	}
+
+	// without a page size or with skip, the legacy unpaged listing
+	if c.Query("cursor") == "" && (limit < 0 || skip > 0) {
+		items, err := storage.LogQuery(c.Request.Context(), from, to, limit, skip, filter, fields)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+			return
+		}
+		c.JSON(http.StatusOK, items)
+		return
+	}
+
+	page, ok := pageParams(c, limit, skip, defaultPageSize)
+	if !ok {
+		return
+	}
+	items, res, err := storage.LogPage(c.Request.Context(), from, to, filter, fields, page)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
 		return
 	}
 
+	setPage(c, res)
 	c.JSON(http.StatusOK, items)
 }
 
 func LogStats(c *gin.Context) {
-	fromT, toT, limit, skip, ok := validateAndNormalizeRange(c)
+	q, ok := statsParams(c)
 	if !ok {
 		return
 	}
+	if q.empty {
+		c.JSON(http.StatusOK, []models.LogChartPoint{})
+		return
+	}
+
+	points, err := storage.LogStats(c.Request.Context(), q.from, q.to, q.groupBy, q.filter, q.interval, q.loc)
 
-	last, err := storage.LogLatest(c.Request.Context(), fromT, toT, limit, skip)
+	if errors.Is(err, storage.ErrTooManyGroups) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_last_failed"})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_aggregate_failed"})
 		return
 	}
+
+	c.JSON(http.StatusOK, points)
+}
+
+// statsQuery holds the parameters shared by the bucketed stats endpoints.
+type statsQuery struct {
+	from, to time.Time
+	groupBy  string
+	filter   storage.LogFilter
+	interval storage.StatsInterval
+	loc      *time.Location
+	// no log matches, so there is nothing to bucket
+	empty bool
+}
+
+// statsParams reads the range, filters, group_by, tz and interval. The range
+// ends at the newest matching log rather than at to.
+func statsParams(c *gin.Context) (statsQuery, bool) {
+	var q statsQuery
+	fromT, toT, limit, skip, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return q, false
+	}
+
+	q.groupBy = c.Query("group_by")
+	if q.groupBy != "" && !storage.LogGroupFields[q.groupBy] {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_group_by"})
+		return q, false
+	}
+	// buckets of a day or longer start at midnight in tz (IANA name)
+	q.loc = time.UTC
+	if tz := c.Query("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil || tz == "Local" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_tz"})
+			return q, false
+		}
+		q.loc = l
+	}
+	q.filter, ok = logFilter(c)
+	if !ok {
+		return q, false
+	}
+
+	last, err := storage.LogLatest(c.Request.Context(), fromT, toT, limit, skip, q.filter)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_last_failed"})
+		return q, false
+	}
 	if last == nil {
-		c.JSON(http.StatusOK, []models.LogChartPoint{})
+		q.empty = true
+		return q, true
+	}
+	q.from, q.to = *fromT, *last
+
+	q.interval, err = storage.StatsIntervalFor(c.Query("interval"), q.from, q.to)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return q, false
+	}
+	c.Header("Stats-Interval", q.interval.Name)
+	return q, true
+}
+
+// LogGet returns one log with its Data.
+func LogGet(c *gin.Context) {
+	l, err := storage.LogGetByReqID(c.Request.Context(), c.Param("req_id"))
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
 		return
 	}
 
-	effectiveTo := *last
+	c.JSON(http.StatusOK, l)
+}
 
-	points, err := storage.LogStats(c.Request.Context(), *fromT, effectiveTo)
+// LogData returns the Data of one log, which list views leave out unless
+// asked for with fields=data.
+func LogData(c *gin.Context) {
+	data, err := storage.LogDataByReqID(c.Request.Context(), c.Param("req_id"))
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+const (
+	timelineWindow    = time.Hour
+	timelineWindowMax = 24 * time.Hour
+	timelineLimit     = 500
+)
 
+// LogTimeline returns the logs correlated with one request, oldest first.
+// window (a duration, default 1h) bounds how far from the request's
+// timestamp related logs are looked for.
+func LogTimeline(c *gin.Context) {
+	window := timelineWindow
+	if v := c.Query("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > timelineWindowMax {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_window"})
+			return
+		}
+		window = d
+	}
+
+	root, err := storage.LogGetByReqID(c.Request.Context(), c.Param("req_id"))
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_aggregate_failed"})
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
 		return
 	}
 
-	c.JSON(http.StatusOK, points)
+	items, err := storage.LogTimeline(c.Request.Context(), root, window, timelineLimit)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
 }
 
 type LogCountResponse struct {
@@ -105,29 +378,22 @@ func LogCount(c *gin.Context) {
 		return
 	}
 
-	now := time.Now().UTC()
-	lastFrom := now.Add(-24 * time.Hour)
-	lastTo := now
-
-	totalAll, err := storage.LogCount(c.Request.Context(), from, to, limit, skip)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_count_failed"})
+	filter, ok := logFilter(c)
+	if !ok {
 		return
 	}
 
-	lastAll, err := storage.LogCount(c.Request.Context(), &lastFrom, &lastTo, limit, skip)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_count_failed"})
-		return
-	}
+	now := time.Now().UTC()
+	lastFrom := now.Add(-24 * time.Hour)
+	lastTo := now
 
-	totalErrors, err := storage.LogCountErrors(c.Request.Context(), from, to)
+	totalAll, totalErrors, err := storage.LogCounts(c.Request.Context(), from, to, limit, skip, filter)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_count_failed"})
 		return
 	}
 
-	lastErrors, err := storage.LogCountErrors(c.Request.Context(), &lastFrom, &lastTo)
+	lastAll, lastErrors, err := storage.LogCounts(c.Request.Context(), &lastFrom, &lastTo, limit, skip, filter)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_count_failed"})
 		return
@@ -144,6 +410,86 @@ func LogCount(c *gin.Context) {
 
 // ---------------- Private helpers ----------------
 
+const defaultPageSize = 100
+
+// pageParams reads the cursor parameter. Cursors replace skip, so the two
+// cannot be combined.
+func pageParams(c *gin.Context, limit, skip, def int64) (storage.Page, bool) {
+	p := storage.Page{Limit: limit}
+	if p.Limit <= 0 {
+		p.Limit = def
+	}
+	if v := c.Query("cursor"); v != "" {
+		if skip > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "cursor_with_skip"})
+			return p, false
+		}
+		cur, err := storage.ParseCursor(v)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_cursor"})
+			return p, false
+		}
+		p.Cursor = cur
+	}
+	return p, true
+}
+
+// setPage hands the neighbouring page cursors to ResponseWrapper.
+func setPage(c *gin.Context, res storage.PageResult) {
+	if res.Next != "" {
+		c.Set("next", res.Next)
+	}
+	if res.Prev != "" {
+		c.Set("prev", res.Prev)
+	}
+}
+
+// logFields reads the fields projection: a comma-separated list of log
+// fields and data.<path>s. Without it lists leave out Data.
+func logFields(c *gin.Context) ([]string, bool) {
+	v := strings.TrimSpace(c.Query("fields"))
+	if v == "" {
+		return nil, true
+	}
+	var fields []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !storage.LogFields[name] && !logquery.ValidDataField(name) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_field", "field": name})
+			return nil, false
+		}
+		fields = append(fields, name)
+	}
+	return fields, true
+}
+
+// logFilter reads the URL field filters and the q filter expression. On a
+// malformed q it answers 400 with the position of the problem.
+func logFilter(c *gin.Context) (storage.LogFilter, bool) {
+	f := storage.LogFilter{
+		Host:       strings.ToLower(c.Query("host")),
+		Scheme:     strings.ToLower(c.Query("scheme")),
+		Pathname:   c.Query("pathname"),
+		PathPrefix: c.Query("path_prefix"),
+		Route:      c.Query("route"),
+	}
+	q, err := logquery.Compile(c.Query("q"))
+	if err != nil {
+		var se *logquery.SyntaxError
+		if errors.As(err, &se) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_query", "message": se.Msg, "pos": se.Pos})
+			return f, false
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_query"})
+		return f, false
+	}
+	f.Query = q
+	return f, true
+}
+
 const ZERO = int64(iota)
 const MAX_RANGE = 90 * 24 * time.Hour
 const MAX_LIMIT = 1 << 10
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"metrics/models"
+	"metrics/storage"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	breakdownDefaultLimit = 10
+	breakdownMaxLimit     = 100
+)
+
+// LogBreakdown returns the top values of one dimension over the range:
+//
+//	GET /api/logs/breakdown?by=route&sort=p95&limit=10&from=...&to=...
+//
+// by is route, host, method, pathname, scheme, source or status (exact
+// codes). sort is count (default), error_rate or p95; p95 is null unless
+// sorting by it. The rows past limit are summed into other unless
+// other=false; min_count drops small groups first. The q and field filters
+// of LogList apply.
+func LogBreakdown(c *gin.Context) {
+	by := c.Query("by")
+	if !storage.LogBreakdownFields[by] {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_by"})
+		return
+	}
+	sortBy := c.DefaultQuery("sort", "count")
+	if !storage.LogBreakdownSorts[sortBy] {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_sort"})
+		return
+	}
+	other := true
+	if v := c.Query("other"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_other"})
+			return
+		}
+		other = b
+	}
+	var minCount int64
+	if v := c.Query("min_count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_min_count"})
+			return
+		}
+		minCount = n
+	}
+
+	from, to, limit, _, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return
+	}
+	if limit <= 0 {
+		limit = breakdownDefaultLimit
+	}
+	if limit > breakdownMaxLimit {
+		limit = breakdownMaxLimit
+	}
+	filter, ok := logFilter(c)
+	if !ok {
+		return
+	}
+
+	rows, rest, err := storage.LogBreakdown(c.Request.Context(), from, to, filter, by, sortBy, int(limit), other, minCount)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_aggregate_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Breakdown{By: by, Sort: sortBy, Rows: rows, Other: rest})
+}
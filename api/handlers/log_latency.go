@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"metrics/models"
+	"metrics/storage"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxLatencyEdges = 50
+
+// LogLatency returns Took percentiles, mean and max per bucket. It takes
+// the parameters of LogStats.
+func LogLatency(c *gin.Context) {
+	q, ok := statsParams(c)
+	if !ok {
+		return
+	}
+	if q.empty {
+		c.JSON(http.StatusOK, []models.LatencyPoint{})
+		return
+	}
+
+	points, err := storage.LogLatency(c.Request.Context(), q.from, q.to, q.groupBy, q.filter, q.interval, q.loc)
+	if errors.Is(err, storage.ErrTooManyGroups) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_aggregate_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, points)
+}
+
+// LogLatencyHistogram counts logs per Took bin over the range. edges is a
+// comma-separated ascending list of bin starts in milliseconds.
+func LogLatencyHistogram(c *gin.Context) {
+	q, ok := statsParams(c)
+	if !ok {
+		return
+	}
+	edges, ok := latencyEdges(c)
+	if !ok {
+		return
+	}
+	if q.empty {
+		c.JSON(http.StatusOK, models.LatencyHistogram{Edges: edges, Counts: make([]int64, len(edges))})
+		return
+	}
+
+	h, err := storage.LogLatencyHistogram(c.Request.Context(), q.from, q.to, q.filter, edges)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_aggregate_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h)
+}
+
+// LogLatencyHeatmap is LogLatencyHistogram per interval bucket.
+func LogLatencyHeatmap(c *gin.Context) {
+	q, ok := statsParams(c)
+	if !ok {
+		return
+	}
+	edges, ok := latencyEdges(c)
+	if !ok {
+		return
+	}
+	if q.empty {
+		c.JSON(http.StatusOK, models.LatencyHeatmap{Edges: edges, Rows: []models.LatencyHeatmapRow{}})
+		return
+	}
+
+	hm, err := storage.LogLatencyHeatmap(c.Request.Context(), q.from, q.to, q.filter, edges, q.interval, q.loc)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_aggregate_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, hm)
+}
+
+func latencyEdges(c *gin.Context) ([]int64, bool) {
+	v := c.Query("edges")
+	if v == "" {
+		return storage.LatencyEdges, true
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) > maxLatencyEdges {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_edges"})
+		return nil, false
+	}
+	edges := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+		if err != nil || n < 0 || (len(edges) > 0 && n <= edges[len(edges)-1]) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_edges"})
+			return nil, false
+		}
+		edges = append(edges, n)
+	}
+	return edges, true
+}
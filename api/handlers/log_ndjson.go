@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"metrics/constraints"
+	"metrics/ingest"
+	"metrics/middlewares"
+	"metrics/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ndjsonContentType = constraints.NDJSON
+	ndjsonBatchSize   = 500
+	ndjsonMaxLine     = 1 << 20
+	ndjsonMaxRejected = 1000
+)
+
+type ndjsonRejection struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ndjsonSummary struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Spooled    int               `json:"spooled"`
+	Sampled    int               `json:"sampled"`
+	Rejected   int               `json:"rejected"`
+	Errors     []ndjsonRejection `json:"errors"`
+
+	// rejected lines as received, for the dead-letter store
+	raw []byte
+}
+
+func (s *ndjsonSummary) reject(line int, reason string, raw []byte) {
+	s.Rejected++
+	if len(s.Errors) < ndjsonMaxRejected {
+		s.Errors = append(s.Errors, ndjsonRejection{Line: line, Error: reason})
+	}
+	if raw != nil && len(s.raw) <= deadLetterMaxPayload {
+		s.raw = append(append(s.raw, raw...), '\n')
+	}
+}
+
+func (s *ndjsonSummary) deadLetter(c *gin.Context) {
+	if s.Rejected == 0 {
+		return
+	}
+	errs := make([]string, len(s.Errors))
+	for i, e := range s.Errors {
+		errs[i] = fmt.Sprintf("line %d: %s", e.Line, e.Error)
+	}
+	deadLetter(c, models.DeadLetterLogs, s.Errors[0].Error, errs, s.raw)
+}
+
+// logCreateNDJSON streams newline-delimited log entries from the request body
+// and writes them in batches, so a backfill never has to fit in memory. It
+// bypasses the write-behind queue: the stream is already batched and the
+// caller wants to know what was stored.
+func logCreateNDJSON(c *gin.Context) {
+	var (
+		summary = ndjsonSummary{Errors: make([]ndjsonRejection, 0)}
+		source  = ingestSource(c)
+		reader  = bufio.NewReaderSize(c.Request.Body, 64<<10)
+		batch   = make([]models.Log, 0, ndjsonBatchSize)
+		lines   = make([]int, 0, ndjsonBatchSize)
+		line    = 0
+	)
+
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		kept, dropped := ingest.Prepare(batch)
+		keptLines := make([]int, 0, len(kept))
+		for i, d := range dropped {
+			if d {
+				summary.Sampled++
+				continue
+			}
+			keptLines = append(keptLines, lines[i])
+		}
+		results, err := ingest.Store(c.Request.Context(), kept)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed", "line": lines[0], "summary": summary})
+			return false
+		}
+		for i, r := range results {
+			switch r.Status {
+			case models.LogItemInserted:
+				summary.Accepted++
+			case models.LogItemDuplicate:
+				summary.Duplicates++
+			case models.LogItemSpooled:
+				summary.Spooled++
+			default:
+				summary.reject(keptLines[i], r.Error, nil)
+			}
+		}
+		batch = batch[:0]
+		lines = lines[:0]
+		return true
+	}
+
+	for {
+		b, tooLong, err := readNDJSONLine(reader, ndjsonMaxLine)
+		if err == nil || len(b) > 0 || tooLong {
+			line++
+		}
+		switch {
+		case tooLong:
+			summary.reject(line, "line_too_long", nil)
+		case len(b) > 0:
+			entry, perr := models.LogFromJSON(b)
+			if perr != nil {
+				summary.reject(line, perr.Error(), b)
+				break
+			}
+			entry.Source = source
+			batch = append(batch, entry)
+			lines = append(lines, line)
+			if len(batch) >= ndjsonBatchSize && !flush() {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if middlewares.BodyTooLarge(err) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body_too_large", "line": line, "summary": summary})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "read_failed", "line": line, "summary": summary})
+			return
+		}
+	}
+
+	if !flush() {
+		return
+	}
+	summary.deadLetter(c)
+
+	if summary.Accepted == 0 && summary.Duplicates == 0 && summary.Spooled == 0 && summary.Sampled == 0 && summary.Rejected == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "empty_body"})
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// readNDJSONLine returns the next line without its terminator. Lines longer
+// than max are skipped up to the next newline and reported via tooLong.
+func readNDJSONLine(r *bufio.Reader, max int) (line []byte, tooLong bool, err error) {
+	var buf []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(buf)+len(chunk) > max {
+				tooLong = true
+				buf = nil
+			} else {
+				buf = append(buf, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong {
+			return nil, true, err
+		}
+		return bytes.TrimSpace(buf), false, err
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"metrics/models"
+	"metrics/storage"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	searchMaxText      = 512
+	searchDefaultLimit = 50
+)
+
+type logSearchHit struct {
+	models.Log
+	Score      float64            `json:"score"`
+	Highlights []models.Highlight `json:"highlights"`
+}
+
+// LogSearch finds logs by words in their path or captured payloads:
+//
+//	GET /api/logs/search?text=connection+refused&from=...&to=...
+//
+// text follows Mongo $text syntax: words, "exact phrases" and -excluded
+// words. The range, the q and field filters and the fields projection of
+// LogList apply on top.
+func LogSearch(c *gin.Context) {
+	text := strings.TrimSpace(c.Query("text"))
+	if text == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing_text"})
+		return
+	}
+	if len(text) > searchMaxText {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "text_too_long"})
+		return
+	}
+
+	from, to, limit, skip, ok := validateAndNormalizeRange(c)
+	if !ok {
+		return
+	}
+	if limit < 0 {
+		limit = searchDefaultLimit
+	}
+	filter, ok := logFilter(c)
+	if !ok {
+		return
+	}
+	fields, ok := logFields(c)
+	if !ok {
+		return
+	}
+
+	hits, err := storage.LogSearch(c.Request.Context(), from, to, text, filter, fields, limit, skip)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	terms := models.SearchTerms(text)
+	out := make([]logSearchHit, len(hits))
+	for i, h := range hits {
+		out[i] = logSearchHit{Log: h.Log, Score: h.Score, Highlights: []models.Highlight{}}
+		if hl, ok := models.HighlightText("path", h.Path, terms); ok {
+			out[i].Highlights = append(out[i].Highlights, hl)
+		}
+		if hl, ok := models.HighlightText("data", h.Search, terms); ok {
+			out[i].Highlights = append(out[i].Highlights, hl)
+		}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"metrics/ingest"
+	"metrics/middlewares"
+	"metrics/models"
+	"metrics/otlp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OTLPLogs is the OTLP/HTTP logs receiver. It lives outside the /api group
+// because exporters expect a bare ExportLogsServiceResponse, not the JSON
+// envelope. HTTP records go through the same path as LogCreate, the others
+// are stored as events.
+func OTLPLogs(c *gin.Context) {
+	contentType := c.ContentType()
+	if contentType != otlp.ContentTypeProtobuf && contentType != otlp.ContentTypeJSON {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported_content_type"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if middlewares.BodyTooLarge(err) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body_too_large"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "read_failed"})
+		return
+	}
+
+	req, err := otlp.Decode(body, contentType)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_otlp_payload"})
+		return
+	}
+
+	batch, events := otlp.ToLogs(req, ingestSource(c))
+	invalid := make([]error, len(batch))
+	for i := range batch {
+		batch[i].EnsureReqID()
+		invalid[i] = batch[i].Validate()
+	}
+
+	resp, err := acceptLogs(c, ingestSource(c), batch, invalid)
+	if err != nil {
+		if errors.Is(err, ingest.ErrQueueFull) || errors.Is(err, ingest.ErrQueueClosed) {
+			// OTLP exporters retry 429 and 503 with backoff.
+			abortAccept(c, err)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "db_insert_failed"})
+		return
+	}
+
+	// logs and events of a retried export are both dropped as duplicates
+	if err := ingest.StoreEvents(c.Request.Context(), events); err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "db_insert_failed"})
+		return
+	}
+
+	rejected := int64(resp.Invalid + resp.Failed)
+	message := ""
+	if rejected > 0 {
+		message = fmt.Sprintf("%d log records rejected", rejected)
+		for _, it := range resp.Items {
+			if it.Status == models.LogItemInvalid || it.Status == models.LogItemFailed {
+				message += ", first: " + it.Error
+				break
+			}
+		}
+	}
+
+	out, err := otlp.EncodeResponse(rejected, message, contentType)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "encode_failed"})
+		return
+	}
+	c.Data(http.StatusOK, contentType, out)
+}
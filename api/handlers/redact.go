@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"metrics/models"
+	"metrics/redact"
+	"metrics/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type redactPreviewResponse struct {
+	Logs []models.Log   `json:"logs"`
+	Hits [][]redact.Hit `json:"hits"`
+}
+
+// RedactPreview runs the active redaction rules over the posted log entries
+// without storing anything. Entries are not validated, so a bare
+// {"data": {...}} object works too.
+func RedactPreview(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil || len(body) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "empty_body"})
+		return
+	}
+
+	var batch []models.Log
+	if err := json.Unmarshal(body, &batch); err != nil {
+		var one models.Log
+		if err := json.Unmarshal(body, &one); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_json"})
+			return
+		}
+		batch = []models.Log{one}
+	}
+
+	resp := redactPreviewResponse{Logs: batch, Hits: make([][]redact.Hit, len(batch))}
+	for i := range batch {
+		resp.Hits[i] = utils.EnsureNonNilSlice(redact.Log(&batch[i]))
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
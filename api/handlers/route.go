@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"metrics/models"
+	"metrics/routes"
+	"metrics/storage"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type routeTemplateDTO struct {
+	Pattern string `json:"pattern" validate:"required,max=512"`
+	Host    string `json:"host" validate:"max=255"`
+}
+
+func RouteTemplateCreate(c *gin.Context) {
+	var payload routeTemplateDTO
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_payload"})
+		return
+	}
+	if err := validate.Struct(payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "validation_failed"})
+		return
+	}
+
+	u, _ := c.MustGet("user").(models.User)
+	t := models.RouteTemplate{
+		Pattern:   strings.TrimSpace(payload.Pattern),
+		Host:      strings.ToLower(strings.TrimSpace(payload.Host)),
+		CreatedBy: u.ID,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := t.Validate(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := storage.RouteTemplateCreate(ctx, &t); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "route_exists"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed"})
+		return
+	}
+	if err := routes.Load(ctx); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "routes_reload_failed"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, t)
+}
+
+func RouteTemplateList(c *gin.Context) {
+	items, err := storage.RouteTemplateList(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func RouteTemplateDelete(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_id"})
+		return
+	}
+
+	if err := storage.RouteTemplateDelete(c.Request.Context(), id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_delete_failed"})
+		return
+	}
+	if err := routes.Load(c.Request.Context()); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "routes_reload_failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// RoutePreview shows the route a path would be stored under.
+func RoutePreview(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path_required"})
+		return
+	}
+	p := models.SplitURL(path)
+	c.JSON(http.StatusOK, gin.H{
+		"host":     p.Host,
+		"pathname": p.Pathname,
+		"route":    routes.Route(p.Host, p.Pathname),
+	})
+}
+
+// renormalizeJob is the state of the last RouteRenormalize run. Runs take
+// minutes over a wide range, so they are not tied to the request.
+type renormalizeJob struct {
+	State      string                     `json:"state"` // running, done or failed
+	From       time.Time                  `json:"from"`
+	To         time.Time                  `json:"to"`
+	StartedAt  time.Time                  `json:"startedAt"`
+	FinishedAt *time.Time                 `json:"finishedAt,omitempty"`
+	Result     *storage.RenormalizeResult `json:"result,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+}
+
+var (
+	renormalizeMu  sync.Mutex
+	renormalizeRun *renormalizeJob
+)
+
+// RouteRenormalize starts recomputing the route of stored logs between from
+// and to with the current templates, and the rollups of the range. It
+// answers 202 with the job; RouteRenormalizeStatus follows it. Only one run
+// at a time. The job runs under ctx, so it stops on shutdown.
+func RouteRenormalize(ctx context.Context) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, _, _, ok := validateAndNormalizeRange(c)
+		if !ok {
+			return
+		}
+		if err := routes.Load(c.Request.Context()); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "routes_reload_failed"})
+			return
+		}
+
+		renormalizeMu.Lock()
+		defer renormalizeMu.Unlock()
+		if renormalizeRun != nil && renormalizeRun.State == "running" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "renormalize_running"})
+			return
+		}
+		job := &renormalizeJob{State: "running", From: *from, To: *to, StartedAt: time.Now().UTC()}
+		renormalizeRun = job
+
+		go func(from, to time.Time) {
+			res, err := storage.LogRenormalize(ctx, from, to, routes.Route)
+			if err != nil {
+				log.Printf("renormalize %s..%s: %v", from.Format(time.RFC3339), to.Format(time.RFC3339), err)
+			}
+
+			renormalizeMu.Lock()
+			defer renormalizeMu.Unlock()
+			now := time.Now().UTC()
+			job.FinishedAt = &now
+			job.Result = &res
+			job.State = "done"
+			if err != nil {
+				job.State = "failed"
+				job.Error = "db_update_failed"
+			}
+		}(*from, *to)
+
+		c.JSON(http.StatusAccepted, *job)
+	}
+}
+
+// RouteRenormalizeStatus returns the running or last finished renormalize
+// job of this instance.
+func RouteRenormalizeStatus(c *gin.Context) {
+	renormalizeMu.Lock()
+	defer renormalizeMu.Unlock()
+	if renormalizeRun == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not_found"})
+		return
+	}
+	c.JSON(http.StatusOK, *renormalizeRun)
+}
@@ -1,25 +1,37 @@
 package handlers
 
 import (
+	"metrics/middlewares"
 	"metrics/models"
+	"metrics/spool"
 	"metrics/storage"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func SpeedtestCreate(c *gin.Context) {
 	var in models.Speedtest
-	if err := c.ShouldBindJSON(&in); err != nil {
+	if err := c.ShouldBindBodyWith(&in, binding.JSON); err != nil {
+		if middlewares.BodyTooLarge(err) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body_too_large"})
+			return
+		}
+		if body, ok := c.Get(gin.BodyBytesKey); ok {
+			b, _ := body.([]byte)
+			deadLetter(c, models.DeadLetterSpeedtest, "invalid_speedtest", []string{err.Error()}, b)
+		}
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	now := time.Now().UTC()
 	in.ReceivedAt = &now
+	in.Source = ingestSource(c)
 
 	if err := storage.SpeedtestInsert(c.Request.Context(), &in); err != nil {
 		if we, ok := err.(mongo.WriteException); ok {
@@ -30,6 +42,12 @@ func SpeedtestCreate(c *gin.Context) {
 				}
 			}
 		}
+		if _, ok := err.(mongo.WriteException); !ok && spool.Enabled() {
+			if serr := spool.AppendSpeedtest(&in); serr == nil {
+				c.JSON(http.StatusAccepted, true)
+				return
+			}
+		}
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_insert_failed"})
 		return
 	}
@@ -67,15 +85,33 @@ func SpeedtestList(c *gin.Context) {
 		to = &t
 	}
 
-	items, err := storage.SpeedtestQuery(c.Request.Context(), from, to)
+	limit := int64(speedtestPageSize)
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_limit"})
+			return
+		}
+		limit = min(n, speedtestPageSize)
+	}
+	page, ok := pageParams(c, limit, 0, speedtestPageSize)
+	if !ok {
+		return
+	}
+
+	items, res, err := storage.SpeedtestPage(c.Request.Context(), from, to, page)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "db_query_failed"})
 		return
 	}
 
+	setPage(c, res)
 	c.JSON(http.StatusOK, items)
 }
 
+// speedtestPageSize is both the default and the largest page.
+const speedtestPageSize = 1000
+
 type trendingResponse struct {
 	Total struct {
 		Sum      int64 `json:"sum"`
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"metrics/storage"
+)
+
+// runIndexSearch fills the full-text search field on logs stored before
+// ingest started indexing Data. Like migrate-urls it only touches documents
+// that lack the field, so it can be interrupted and re-run.
+func runIndexSearch(args []string) int {
+	fs := flag.NewFlagSet("index-search", flag.ExitOnError)
+	batchSize := fs.Int("batch", 1000, "updates per bulk write")
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	disconnect, ok := commandStorage(ctx)
+	if !ok {
+		return 1
+	}
+	defer disconnect()
+
+	n, err := storage.LogIndexSearch(ctx, *batchSize, func(done int64) {
+		log.Printf("index-search: %d logs updated", done)
+	})
+	if err != nil {
+		log.Printf("index-search: %v (after %d logs)", err, n)
+		return 1
+	}
+	log.Printf("index-search: done, %d logs updated", n)
+	return 0
+}
@@ -0,0 +1,53 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"metrics/models"
+	"metrics/redact"
+	"metrics/spool"
+	"metrics/storage"
+)
+
+// StoreEvents masks the events and stores them. Events already stored under
+// their EventID are skipped as duplicates; it fails when any other event
+// could not be written, so the source can retry the batch. Like Store, it
+// parks the events in the spool when the database cannot be reached.
+func StoreEvents(ctx context.Context, events []models.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	for i := range events {
+		redact.Event(&events[i])
+	}
+	res, err := storage.EventInsert(ctx, events)
+	if err != nil {
+		if !spool.Enabled() {
+			return err
+		}
+		if serr := spool.AppendEvents(events); serr != nil {
+			log.Printf("ingest: spooling %d events failed: %v", len(events), serr)
+			return err
+		}
+		return nil
+	}
+	if len(res.Failed) > 0 {
+		return fmt.Errorf("%d of %d events not stored", len(res.Failed), len(events))
+	}
+	return nil
+}
+
+// ReplayEvents is the spool replayer for events, which were masked before
+// they were spooled. Events failing on their own are dropped.
+func ReplayEvents(ctx context.Context, events []models.Event) error {
+	res, err := storage.EventInsert(ctx, events)
+	if err != nil {
+		return err
+	}
+	for i, e := range res.Failed {
+		log.Printf("ingest: dropping spooled event %s: %v", events[i].EventID, e)
+	}
+	return nil
+}
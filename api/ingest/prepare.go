@@ -0,0 +1,30 @@
+package ingest
+
+import (
+	"metrics/models"
+	"metrics/redact"
+	"metrics/routes"
+	"metrics/sampling"
+)
+
+// Prepare runs the ingest-time transformations on validated entries before
+// they are queued, stored or broadcast. It returns the entries that survive
+// sampling, in order; dropped[i] reports whether batch[i] was sampled out.
+func Prepare(batch []models.Log) (kept []models.Log, dropped []bool) {
+	kept = make([]models.Log, 0, len(batch))
+	dropped = make([]bool, len(batch))
+	for i := range batch {
+		batch[i].HasData = false // computed on read, never stored
+		batch[i].DecomposePath()
+		batch[i].Route = routes.Route(batch[i].Host, batch[i].Pathname)
+		batch[i].Correlate()
+		if !sampling.Keep(&batch[i]) {
+			dropped[i] = true
+			continue
+		}
+		redact.Log(&batch[i])
+		batch[i].IndexSearch()
+		kept = append(kept, batch[i])
+	}
+	return kept, dropped
+}
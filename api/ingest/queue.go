@@ -0,0 +1,285 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metrics/models"
+)
+
+var (
+	ErrQueueFull   = errors.New("queue_full")
+	ErrQueueClosed = errors.New("queue_closed")
+)
+
+type QueueConfig struct {
+	// Capacity is the number of log entries buffered in memory. Zero
+	// disables the queue and ingestion writes synchronously.
+	Capacity      int
+	BatchSize     int
+	FlushInterval time.Duration
+	Workers       int
+	WriteTimeout  time.Duration
+}
+
+type QueueStats struct {
+	Enabled         bool    `json:"enabled"`
+	Depth           int     `json:"depth"`
+	Capacity        int     `json:"capacity"`
+	Enqueued        int64   `json:"enqueued"`
+	Inserted        int64   `json:"inserted"`
+	Duplicates      int64   `json:"duplicates"`
+	Spooled         int64   `json:"spooled"`
+	DroppedFull     int64   `json:"droppedFull"`
+	DroppedFailed   int64   `json:"droppedFailed"`
+	Flushes         int64   `json:"flushes"`
+	FlushLastMs     float64 `json:"flushLastMs"`
+	FlushMeanMs     float64 `json:"flushMeanMs"`
+	FlushMaxMs      float64 `json:"flushMaxMs"`
+	FlushIntervalMs int64   `json:"flushIntervalMs"`
+}
+
+type queue struct {
+	cfg QueueConfig
+
+	mu     sync.Mutex
+	buf    []models.Log
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	enqueued      atomic.Int64
+	inserted      atomic.Int64
+	duplicates    atomic.Int64
+	spooled       atomic.Int64
+	droppedFull   atomic.Int64
+	droppedFailed atomic.Int64
+	flushes       atomic.Int64
+	flushTotal    atomic.Int64
+	flushLast     atomic.Int64
+	flushMax      atomic.Int64
+}
+
+var logQueue *queue
+
+// Start launches the write-behind workers. It is a no-op when the configured
+// capacity is zero.
+func Start(cfg QueueConfig) {
+	if cfg.Capacity <= 0 {
+		return
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10 * time.Second
+	}
+
+	q := &queue{
+		cfg:  cfg,
+		buf:  make([]models.Log, 0, cfg.Capacity),
+		wake: make(chan struct{}, cfg.Workers),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	logQueue = q
+}
+
+// Stop refuses new entries, flushes whatever is buffered and waits for the
+// workers to finish or for ctx to expire.
+func Stop(ctx context.Context) error {
+	q := logQueue
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+	q.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Enabled() bool {
+	return logQueue != nil
+}
+
+// RetryAfter is how long a client rejected with ErrQueueFull should wait.
+func RetryAfter() time.Duration {
+	if logQueue == nil {
+		return time.Second
+	}
+	return logQueue.cfg.FlushInterval
+}
+
+// Enqueue buffers the batch for a later bulk write. The batch is accepted or
+// rejected as a whole.
+func Enqueue(batch []models.Log) error {
+	q := logQueue
+	if q == nil {
+		return ErrQueueClosed
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	if len(q.buf)+len(batch) > q.cfg.Capacity {
+		q.mu.Unlock()
+		q.droppedFull.Add(int64(len(batch)))
+		return ErrQueueFull
+	}
+	q.buf = append(q.buf, batch...)
+	full := len(q.buf) >= q.cfg.BatchSize
+	q.mu.Unlock()
+
+	q.enqueued.Add(int64(len(batch)))
+	if full {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func Stats() QueueStats {
+	q := logQueue
+	if q == nil {
+		return QueueStats{}
+	}
+	q.mu.Lock()
+	depth := len(q.buf)
+	q.mu.Unlock()
+
+	st := QueueStats{
+		Enabled:         true,
+		Depth:           depth,
+		Capacity:        q.cfg.Capacity,
+		Enqueued:        q.enqueued.Load(),
+		Inserted:        q.inserted.Load(),
+		Duplicates:      q.duplicates.Load(),
+		Spooled:         q.spooled.Load(),
+		DroppedFull:     q.droppedFull.Load(),
+		DroppedFailed:   q.droppedFailed.Load(),
+		Flushes:         q.flushes.Load(),
+		FlushLastMs:     msOf(q.flushLast.Load()),
+		FlushMaxMs:      msOf(q.flushMax.Load()),
+		FlushIntervalMs: q.cfg.FlushInterval.Milliseconds(),
+	}
+	if st.Flushes > 0 {
+		st.FlushMeanMs = msOf(q.flushTotal.Load() / st.Flushes)
+	}
+	return st
+}
+
+func (q *queue) worker() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		case <-q.done:
+			q.drain(1)
+			return
+		}
+		q.drain(q.cfg.BatchSize)
+	}
+}
+
+// drain keeps flushing while each flush takes at least atLeast entries.
+func (q *queue) drain(atLeast int) {
+	for {
+		if n := q.flushOnce(); n == 0 || n < atLeast {
+			return
+		}
+	}
+}
+
+// flushOnce writes up to one batch and returns how many entries it took.
+func (q *queue) flushOnce() int {
+	q.mu.Lock()
+	n := min(len(q.buf), q.cfg.BatchSize)
+	if n == 0 {
+		q.mu.Unlock()
+		return 0
+	}
+	batch := make([]models.Log, n)
+	copy(batch, q.buf[:n])
+	q.buf = append(q.buf[:0], q.buf[n:]...)
+	q.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.cfg.WriteTimeout)
+	defer cancel()
+
+	started := time.Now()
+	results, err := Store(ctx, batch)
+	q.observe(time.Since(started))
+
+	if err != nil {
+		log.Printf("ingest: flush of %d logs failed: %v", n, err)
+		q.droppedFailed.Add(int64(n))
+		return n
+	}
+	for _, r := range results {
+		switch r.Status {
+		case models.LogItemInserted:
+			q.inserted.Add(1)
+		case models.LogItemDuplicate:
+			q.duplicates.Add(1)
+		case models.LogItemSpooled:
+			q.spooled.Add(1)
+		default:
+			q.droppedFailed.Add(1)
+		}
+	}
+	return n
+}
+
+func (q *queue) observe(d time.Duration) {
+	q.flushes.Add(1)
+	q.flushTotal.Add(int64(d))
+	q.flushLast.Store(int64(d))
+	for {
+		cur := q.flushMax.Load()
+		if int64(d) <= cur || q.flushMax.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+func msOf(ns int64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
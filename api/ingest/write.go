@@ -0,0 +1,142 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"metrics/broadcast"
+	"metrics/models"
+	"metrics/spool"
+	"metrics/storage"
+)
+
+// Write stores the batch synchronously and broadcasts the entries that were
+// actually written. The returned results are indexed relative to batch.
+func Write(ctx context.Context, batch []models.Log) ([]models.LogItemResult, error) {
+	res, err := Insert(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]models.LogItemResult, len(batch))
+	for i := range batch {
+		out[i] = models.LogItemResult{Index: i, ReqID: batch[i].ReqID, Status: models.LogItemInserted}
+	}
+	for _, i := range res.Duplicates {
+		out[i].Status = models.LogItemDuplicate
+	}
+	for i, e := range res.Failed {
+		out[i].Status = models.LogItemFailed
+		out[i].Error = e.Error()
+	}
+	for i := range batch {
+		if out[i].Status == models.LogItemInserted {
+			broadcast.Log(batch[i])
+		}
+	}
+	return out, nil
+}
+
+// Insert stores the batch and keeps the rollups in step: the inserted logs
+// are added to them, and the hours of the duplicates, and of the inserted
+// logs when that fails, are marked dirty. A failed mark is kept and retried
+// by storage.
+func Insert(ctx context.Context, batch []models.Log) (storage.InsertResult, error) {
+	res, err := storage.LogInsert(ctx, batch)
+	if err != nil {
+		return res, err
+	}
+	added := inserted(batch, res)
+	dirty := make([]models.Log, 0, len(res.Duplicates))
+	for _, i := range res.Duplicates {
+		dirty = append(dirty, batch[i])
+	}
+	// the logs are stored; the hours whose rollups miss them are rebuilt
+	if err := storage.LogRollup(ctx, added); err != nil {
+		log.Printf("ingest: rollups of %d logs: %v", len(added), err)
+		dirty = append(dirty, added...)
+	}
+	if err := storage.LogRollupDirty(ctx, dirty); err != nil {
+		log.Printf("ingest: marking rollups of %d logs dirty, will retry: %v", len(dirty), err)
+	}
+	return res, nil
+}
+
+// inserted drops the duplicates and failures of res from batch.
+func inserted(batch []models.Log, res storage.InsertResult) []models.Log {
+	skip := make(map[int]bool, len(res.Duplicates)+len(res.Failed))
+	for _, i := range res.Duplicates {
+		skip[i] = true
+	}
+	for i := range res.Failed {
+		skip[i] = true
+	}
+	out := make([]models.Log, 0, len(batch)-len(skip))
+	for i := range batch {
+		if !skip[i] {
+			out = append(out, batch[i])
+		}
+	}
+	return out
+}
+
+// Store writes the batch like Write. When the database cannot be reached the
+// batch is parked in the on-disk spool instead and reported as spooled; the
+// spool replays it later.
+func Store(ctx context.Context, batch []models.Log) ([]models.LogItemResult, error) {
+	out, err := Write(ctx, batch)
+	if err == nil || !spool.Enabled() {
+		return out, err
+	}
+	if serr := spool.AppendLogs(batch); serr != nil {
+		log.Printf("ingest: spooling %d logs failed: %v", len(batch), serr)
+		return nil, err
+	}
+
+	out = make([]models.LogItemResult, len(batch))
+	for i := range batch {
+		out[i] = models.LogItemResult{Index: i, ReqID: batch[i].ReqID, Status: models.LogItemSpooled}
+	}
+	return out, nil
+}
+
+// Replay is the spool replayer for logs. Duplicates are expected when a
+// segment is replayed twice and count as written.
+func Replay(ctx context.Context, batch []models.Log) error {
+	results, err := Write(ctx, batch)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Status == models.LogItemFailed {
+			log.Printf("ingest: dropping spooled log %s: %s", r.ReqID, r.Error)
+		}
+	}
+	return nil
+}
+
+// ReplaySpeedtest is the spool replayer for speedtests. A result the
+// database refuses is dropped rather than holding up the spool.
+func ReplaySpeedtest(ctx context.Context, st *models.Speedtest) error {
+	err := storage.SpeedtestInsertIdempotent(ctx, st)
+	if storage.Refused(err) {
+		return fmt.Errorf("%w: %v", spool.ErrDropped, err)
+	}
+	return err
+}
+
+// Submit is the entry point for sources without a caller waiting on
+// per-entry results: it prepares the batch and queues it, or stores it when
+// the queue is disabled.
+func Submit(ctx context.Context, batch []models.Log) error {
+	batch, _ = Prepare(batch)
+	if len(batch) == 0 {
+		return nil
+	}
+	if Enabled() {
+		return Enqueue(batch)
+	}
+	_, err := Store(ctx, batch)
+	return err
+}
@@ -0,0 +1,267 @@
+package logquery
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxRegexLen = 256
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindUpper            // compared upper-cased, e.g. method
+	kindLower            // compared lower-cased, e.g. host
+	kindNumber
+	kindPath // ":" with a trailing * is a prefix match, "~" a regex
+)
+
+// fields maps the query names to stored fields. Anything else must be a
+// data.* path.
+var fields = map[string]struct {
+	name string
+	kind fieldKind
+}{
+	"status":    {"status", kindNumber},
+	"took":      {"took", kindNumber},
+	"method":    {"method", kindUpper},
+	"host":      {"host", kindLower},
+	"scheme":    {"scheme", kindLower},
+	"path":      {"pathname", kindPath},
+	"route":     {"route", kindPath},
+	"source":    {"source", kindString},
+	"req_id":    {"req_id", kindString},
+	"parent_id": {"parent_id", kindString},
+	"trace_id":  {"trace_id", kindString},
+}
+
+// data paths are dot-separated plain names; no "$", no empty segments
+var dataSegment = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidDataField reports whether field is a well-formed data.<path>.
+func ValidDataField(field string) bool {
+	path, ok := strings.CutPrefix(field, "data.")
+	if !ok {
+		return false
+	}
+	for _, seg := range strings.Split(path, ".") {
+		if !dataSegment.MatchString(seg) {
+			return false
+		}
+	}
+	return true
+}
+
+var classes = map[string][2]int{
+	"1xx": {100, 199},
+	"2xx": {200, 299},
+	"3xx": {300, 399},
+	"4xx": {400, 499},
+	"5xx": {500, 599},
+}
+
+// Compile parses q and returns the equivalent Mongo filter, or nil for an
+// empty query.
+func Compile(q string) (bson.D, error) {
+	n, err := Parse(q)
+	if err != nil || n == nil {
+		return nil, err
+	}
+	return Filter(n)
+}
+
+// Filter turns a parsed query into a Mongo filter document.
+func Filter(n Node) (bson.D, error) {
+	switch x := n.(type) {
+	case And:
+		list, err := filters(x)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$and", Value: list}}, nil
+	case Or:
+		list, err := filters(x)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$or", Value: list}}, nil
+	case Not:
+		f, err := Filter(x.X)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{f}}}, nil
+	case Term:
+		return term(x)
+	}
+	return nil, &SyntaxError{Msg: "unknown node"}
+}
+
+func filters(list []Node) (bson.A, error) {
+	out := make(bson.A, 0, len(list))
+	for _, n := range list {
+		f, err := Filter(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func term(t Term) (bson.D, error) {
+	fail := func(msg string) (bson.D, error) {
+		return nil, &SyntaxError{Pos: t.Pos, Msg: msg}
+	}
+
+	if t.Field == "class" {
+		r, ok := classes[strings.ToLower(t.Value)]
+		if !ok || (t.Op != ":" && t.Op != "!=") {
+			return fail("class takes :1xx to :5xx")
+		}
+		return negate(t.Op, bson.D{{Key: "status", Value: bson.D{
+			{Key: "$gte", Value: r[0]},
+			{Key: "$lte", Value: r[1]},
+		}}}), nil
+	}
+
+	if strings.HasPrefix(t.Field, "data.") {
+		return dataTerm(t)
+	}
+
+	f, ok := fields[t.Field]
+	if !ok {
+		return fail("unknown field " + t.Field)
+	}
+
+	switch f.kind {
+	case kindNumber:
+		// status:5xx is the same as class:5xx
+		if r, ok := classes[strings.ToLower(t.Value)]; ok && f.name == "status" && (t.Op == ":" || t.Op == "!=") {
+			return negate(t.Op, bson.D{{Key: "status", Value: bson.D{
+				{Key: "$gte", Value: r[0]},
+				{Key: "$lte", Value: r[1]},
+			}}}), nil
+		}
+		v, err := strconv.ParseInt(t.Value, 10, 64)
+		if err != nil || t.Op == "~" {
+			return fail(t.Field + " takes a number")
+		}
+		return compare(f.name, t.Op, v)
+	case kindUpper, kindLower, kindString, kindPath:
+		if t.Op == "~" {
+			if len(t.Value) > maxRegexLen {
+				return fail("regex too long")
+			}
+			if _, err := regexp.Compile(t.Value); err != nil {
+				return fail("invalid regex")
+			}
+			// casing the pattern would break escapes like \D or \S; the
+			// stored value is cased, so match it case-insensitively instead
+			re := primitive.Regex{Pattern: t.Value}
+			if f.kind == kindUpper || f.kind == kindLower {
+				re.Options = "i"
+			}
+			return bson.D{{Key: f.name, Value: re}}, nil
+		}
+		v := t.Value
+		switch f.kind {
+		case kindUpper:
+			v = strings.ToUpper(v)
+		case kindLower:
+			v = strings.ToLower(v)
+		}
+		switch t.Op {
+		case ":", "!=":
+			if !t.Quoted && strings.HasSuffix(v, "*") && (f.kind == kindPath || f.kind == kindLower) {
+				if v == "*" {
+					return negate(t.Op, bson.D{{Key: f.name, Value: bson.D{{Key: "$exists", Value: true}}}}), nil
+				}
+				return negate(t.Op, bson.D{{Key: f.name, Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(strings.TrimSuffix(v, "*"))}}}), nil
+			}
+			return negate(t.Op, bson.D{{Key: f.name, Value: v}}), nil
+		}
+		return fail(t.Field + " takes :, != or ~")
+	}
+	return fail("unsupported field")
+}
+
+// dataTerm handles data.<path>: equality, existence with :*, numeric
+// comparisons, and regex.
+func dataTerm(t Term) (bson.D, error) {
+	fail := func(msg string) (bson.D, error) {
+		return nil, &SyntaxError{Pos: t.Pos, Msg: msg}
+	}
+	if !ValidDataField(t.Field) {
+		return fail("invalid data field " + t.Field)
+	}
+	name := t.Field
+
+	switch t.Op {
+	case ":", "!=":
+		if t.Value == "*" && !t.Quoted {
+			return negate(t.Op, bson.D{{Key: name, Value: bson.D{{Key: "$exists", Value: true}}}}), nil
+		}
+		// the raw value is compared as a string and, where it parses as
+		// one, as a number or boolean too
+		candidates := bson.A{t.Value}
+		if !t.Quoted {
+			if n, err := strconv.ParseInt(t.Value, 10, 64); err == nil {
+				candidates = append(candidates, n)
+			} else if f, err := strconv.ParseFloat(t.Value, 64); err == nil {
+				candidates = append(candidates, f)
+			}
+			if b, err := strconv.ParseBool(t.Value); err == nil && (t.Value == "true" || t.Value == "false") {
+				candidates = append(candidates, b)
+			}
+		}
+		return negate(t.Op, bson.D{{Key: name, Value: bson.D{{Key: "$in", Value: candidates}}}}), nil
+	case "~":
+		if len(t.Value) > maxRegexLen {
+			return fail("regex too long")
+		}
+		if _, err := regexp.Compile(t.Value); err != nil {
+			return fail("invalid regex")
+		}
+		return bson.D{{Key: name, Value: primitive.Regex{Pattern: t.Value}}}, nil
+	default:
+		v, err := strconv.ParseFloat(t.Value, 64)
+		if err != nil {
+			return fail(t.Field + " comparison takes a number")
+		}
+		return compare(name, t.Op, v)
+	}
+}
+
+func compare(field, op string, v interface{}) (bson.D, error) {
+	var mop string
+	switch op {
+	case ":":
+		return bson.D{{Key: field, Value: v}}, nil
+	case "!=":
+		mop = "$ne"
+	case ">":
+		mop = "$gt"
+	case ">=":
+		mop = "$gte"
+	case "<":
+		mop = "$lt"
+	case "<=":
+		mop = "$lte"
+	default:
+		return nil, &SyntaxError{Msg: "operator " + op + " not supported on " + field}
+	}
+	return bson.D{{Key: field, Value: bson.D{{Key: mop, Value: v}}}}, nil
+}
+
+func negate(op string, f bson.D) bson.D {
+	if op == "!=" {
+		return bson.D{{Key: "$nor", Value: bson.A{f}}}
+	}
+	return f
+}
@@ -0,0 +1,300 @@
+// Package logquery parses the log filter language used by the q parameter:
+//
+//	status>=500 AND method:POST AND path:/api/*
+//	(class:4xx OR class:5xx) NOT host:internal.example.com
+//	took>1000 data.user.id:42 data.error:*
+//
+// Terms are field, operator and value. Adjacent terms are ANDed; AND, OR and
+// NOT (or a leading "-") combine them and parentheses group. Values may be
+// double-quoted. The parsed tree is turned into a Mongo filter in which user
+// input only ever appears as values, never as field names or operators.
+package logquery
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxQueryLen = 2000
+	maxTerms    = 50
+	maxDepth    = 16
+)
+
+// SyntaxError points at the offending position of the query.
+type SyntaxError struct {
+	Pos int    `json:"pos"`
+	Msg string `json:"message"`
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query: %s at %d", e.Msg, e.Pos)
+}
+
+// Node is a parsed expression: a boolean combination of Terms.
+type Node interface{ node() }
+
+type And []Node
+type Or []Node
+type Not struct{ X Node }
+
+// Term is one comparison such as status>=500 or data.user:*.
+type Term struct {
+	Field string
+	Op    string // ":", "!=", ">", ">=", "<", "<=", "~"
+	Value string
+	// Quoted values are never treated as wildcards or classes.
+	Quoted bool
+	Pos    int
+}
+
+func (And) node()  {}
+func (Or) node()   {}
+func (Not) node()  {}
+func (Term) node() {}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokTerm
+)
+
+type token struct {
+	kind tokenKind
+	term Term
+	pos  int
+}
+
+// Parse parses q. An empty query yields a nil Node.
+func Parse(q string) (Node, error) {
+	if len(q) > maxQueryLen {
+		return nil, &SyntaxError{Pos: maxQueryLen, Msg: "query too long"}
+	}
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	n, err := p.or(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &SyntaxError{Pos: t.pos, Msg: "unexpected token"}
+	}
+	return n, nil
+}
+
+type parser struct {
+	toks  []token
+	i     int
+	terms int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+func (p *parser) next() token { t := p.toks[p.i]; p.i++; return t }
+
+func (p *parser) or(depth int) (Node, error) {
+	first, err := p.and(depth)
+	if err != nil {
+		return nil, err
+	}
+	list := Or{first}
+	for p.peek().kind == tokOr {
+		p.next()
+		n, err := p.and(depth)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	if len(list) == 1 {
+		return first, nil
+	}
+	return list, nil
+}
+
+func (p *parser) and(depth int) (Node, error) {
+	first, err := p.unary(depth)
+	if err != nil {
+		return nil, err
+	}
+	list := And{first}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokNot, tokLParen, tokTerm:
+			// implicit AND
+		default:
+			if len(list) == 1 {
+				return first, nil
+			}
+			return list, nil
+		}
+		n, err := p.unary(depth)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+}
+
+func (p *parser) unary(depth int) (Node, error) {
+	if depth > maxDepth {
+		return nil, &SyntaxError{Pos: p.peek().pos, Msg: "query nested too deeply"}
+	}
+	t := p.next()
+	switch t.kind {
+	case tokNot:
+		x, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return Not{X: x}, nil
+	case tokLParen:
+		n, err := p.or(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, &SyntaxError{Pos: c.pos, Msg: "missing )"}
+		}
+		return n, nil
+	case tokTerm:
+		p.terms++
+		if p.terms > maxTerms {
+			return nil, &SyntaxError{Pos: t.pos, Msg: "too many terms"}
+		}
+		return t.term, nil
+	case tokEOF:
+		return nil, &SyntaxError{Pos: t.pos, Msg: "unexpected end of query"}
+	default:
+		return nil, &SyntaxError{Pos: t.pos, Msg: "expected a term"}
+	}
+}
+
+func lex(q string) ([]token, error) {
+	var toks []token
+	i := 0
+	for {
+		for i < len(q) && unicode.IsSpace(rune(q[i])) {
+			i++
+		}
+		if i >= len(q) {
+			return append(toks, token{kind: tokEOF, pos: i}), nil
+		}
+
+		switch c := q[i]; {
+		case c == '(':
+			toks = append(toks, token{kind: tokLParen, pos: i})
+			i++
+			continue
+		case c == ')':
+			toks = append(toks, token{kind: tokRParen, pos: i})
+			i++
+			continue
+		case c == '-':
+			toks = append(toks, token{kind: tokNot, pos: i})
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(q) && isFieldChar(q[i]) {
+			i++
+		}
+		word := q[start:i]
+		if word == "" {
+			return nil, &SyntaxError{Pos: i, Msg: "expected a field name"}
+		}
+
+		op := operatorAt(q, i)
+		if op == "" {
+			switch strings.ToUpper(word) {
+			case "AND":
+				toks = append(toks, token{kind: tokAnd, pos: start})
+				continue
+			case "OR":
+				toks = append(toks, token{kind: tokOr, pos: start})
+				continue
+			case "NOT":
+				toks = append(toks, token{kind: tokNot, pos: start})
+				continue
+			}
+			return nil, &SyntaxError{Pos: i, Msg: "expected an operator after " + word}
+		}
+		i += len(op)
+
+		value, quoted, n, err := readValue(q, i)
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, token{kind: tokTerm, pos: start, term: Term{
+			Field:  word,
+			Op:     op,
+			Value:  value,
+			Quoted: quoted,
+			Pos:    start,
+		}})
+		i = n
+	}
+}
+
+func isFieldChar(c byte) bool {
+	return c == '.' || c == '_' || c == '-' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func operatorAt(q string, i int) string {
+	for _, op := range []string{">=", "<=", "!=", ":", "=", ">", "<", "~"} {
+		if strings.HasPrefix(q[i:], op) {
+			if op == "=" {
+				return ":"
+			}
+			return op
+		}
+	}
+	return ""
+}
+
+// readValue reads a bare value up to whitespace or an unbalanced ")", or a
+// double-quoted value with backslash escapes.
+func readValue(q string, i int) (value string, quoted bool, next int, err error) {
+	if i < len(q) && q[i] == '"' {
+		var b strings.Builder
+		for j := i + 1; j < len(q); j++ {
+			switch q[j] {
+			case '\\':
+				if j+1 < len(q) {
+					j++
+					b.WriteByte(q[j])
+				}
+			case '"':
+				return b.String(), true, j + 1, nil
+			default:
+				b.WriteByte(q[j])
+			}
+		}
+		return "", false, 0, &SyntaxError{Pos: i, Msg: "unterminated quote"}
+	}
+
+	j := i
+	for j < len(q) && !unicode.IsSpace(rune(q[j])) && q[j] != ')' {
+		j++
+	}
+	if j == i {
+		return "", false, 0, &SyntaxError{Pos: i, Msg: "expected a value"}
+	}
+	return q[i:j], false, j, nil
+}
@@ -4,19 +4,42 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata" // the scratch image has no zoneinfo; LogStats takes tz names
 
 	"metrics/broadcast"
+	"metrics/constraints"
 	"metrics/handlers"
+	"metrics/ingest"
 	"metrics/middlewares"
+	"metrics/models"
+	"metrics/redact"
+	"metrics/routes"
+	"metrics/sampling"
+	"metrics/spool"
 	"metrics/storage"
+	"metrics/syslog"
+	"metrics/utils"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	root, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(root, 10*time.Second)
 	defer cancel()
 
 	if err := storage.Connect(ctx); err != nil {
@@ -27,18 +50,108 @@ func main() {
 	if err := storage.EnsureIndexes(ctx); err != nil {
 		log.Fatalf("mongo indexes: %v", err)
 	}
+	if err := storage.LogRollupStart(ctx); err != nil {
+		log.Fatalf("log rollups: %v", err)
+	}
+	go storage.LogRollupWatch(root, utils.EnvDuration("ROLLUP_REPAIR_INTERVAL", time.Minute))
+
+	redactCfg, err := redact.LoadConfig(os.Getenv("REDACT_CONFIG"))
+	if err != nil {
+		log.Fatalf("redact config: %v", err)
+	}
+	if err := redact.Configure(redactCfg); err != nil {
+		log.Fatalf("redact config: %v", err)
+	}
+
+	if err := middlewares.LoadIngestKeys(ctx); err != nil {
+		log.Fatalf("ingest keys: %v", err)
+	}
+	go middlewares.WatchIngestKeys(root, utils.EnvDuration("INGEST_KEYS_REFRESH_INTERVAL", 30*time.Second))
+
+	if err := routes.Load(ctx); err != nil {
+		log.Fatalf("route templates: %v", err)
+	}
+	go routes.Watch(root, utils.EnvDuration("ROUTES_REFRESH_INTERVAL", time.Minute))
+
+	samplingCfg, err := sampling.LoadConfig(os.Getenv("SAMPLING_CONFIG"))
+	if err != nil {
+		log.Fatalf("sampling config: %v", err)
+	}
+	if err := sampling.Configure(samplingCfg); err != nil {
+		log.Fatalf("sampling config: %v", err)
+	}
+
+	err = spool.Start(spool.Config{
+		Dir:            os.Getenv("SPOOL_DIR"),
+		MaxBytes:       utils.EnvInt64("SPOOL_MAX_BYTES", 1<<30),
+		SegmentBytes:   utils.EnvInt64("SPOOL_SEGMENT_BYTES", 16<<20),
+		ReplayInterval: utils.EnvDuration("SPOOL_REPLAY_INTERVAL", 10*time.Second),
+	}, spool.Replayer{
+		Logs:      ingest.Replay,
+		Speedtest: ingest.ReplaySpeedtest,
+		Events:    ingest.ReplayEvents,
+	})
+	if err != nil {
+		log.Fatalf("spool: %v", err)
+	}
+
+	ingest.Start(ingest.QueueConfig{
+		Capacity:      utils.EnvInt("INGEST_QUEUE_SIZE", 10000),
+		BatchSize:     utils.EnvInt("INGEST_BATCH_SIZE", 500),
+		FlushInterval: utils.EnvDuration("INGEST_FLUSH_INTERVAL", time.Second),
+		Workers:       utils.EnvInt("INGEST_WORKERS", 2),
+	})
+
+	err = syslog.Start(syslog.Config{
+		UDPAddr: os.Getenv("SYSLOG_UDP_ADDR"),
+		TCPAddr: os.Getenv("SYSLOG_TCP_ADDR"),
+	})
+	if err != nil {
+		log.Fatalf("syslog: %v", err)
+	}
 
 	r := gin.New()
+	// only the proxies in front of the API may set X-Forwarded-For, so that
+	// per-IP limits see the real client
+	if err := r.SetTrustedProxies(strings.Split(utils.EnvString("TRUSTED_PROXIES", "127.0.0.1,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16"), ",")); err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
 	r.Use(gin.Recovery())
 	r.Use(cors.New(cors.Config{
 		AllowOriginFunc:  func(origin string) bool { return true },
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With"},
-		ExposeHeaders:    []string{"Authorization", "Set-Cookie"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With", "Content-Encoding", constraints.IngestKey},
+		ExposeHeaders:    []string{"Authorization", "Set-Cookie", "Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Content-Disposition", "Stats-Interval"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
+	// decompressed size cap for ingestion bodies; NDJSON streams get their own
+	ingestBodyLimit := utils.EnvInt64("INGEST_MAX_BODY_BYTES", 32<<20)
+	ingestStreamLimit := utils.EnvInt64("INGEST_MAX_STREAM_BYTES", 16<<30)
+
+	// rate limits
+	if utils.EnvBool("RATE_LIMIT_SHARED", false) {
+		middlewares.UseSharedRateLimits()
+	}
+	// ahead of the key check, so requests with unknown keys are limited too
+	ingestIPLimit := middlewares.RateLimited(
+		middlewares.RateLimit{Name: "ingest-ip", Limit: utils.EnvInt("RATE_LIMIT_INGEST_IP", 60000), Period: time.Minute, Key: middlewares.RateKeyIP},
+	)
+	logsKeyLimit := middlewares.RateLimited(
+		middlewares.RateLimit{Name: "logs-key", Limit: utils.EnvInt("RATE_LIMIT_LOGS_KEY", 60000), Period: time.Minute, Key: middlewares.RateKeyIngestKey},
+	)
+	speedtestKeyLimit := middlewares.RateLimited(
+		middlewares.RateLimit{Name: "speedtest-key", Limit: utils.EnvInt("RATE_LIMIT_SPEEDTEST_KEY", 60), Period: time.Hour, Key: middlewares.RateKeyIngestKey},
+	)
+	loginLimit := middlewares.RateLimited(
+		middlewares.RateLimit{Name: "login-ip", Limit: 20, Period: time.Minute, Key: middlewares.RateKeyIP},
+		middlewares.RateLimit{Name: "login-email", Limit: 10, Period: 15 * time.Minute, Key: middlewares.RateKeyEmail},
+	)
+	registerLimit := middlewares.RateLimited(
+		middlewares.RateLimit{Name: "register-ip", Limit: 5, Period: time.Hour, Key: middlewares.RateKeyIP},
+	)
+
 	api := r.Group("/api")
 
 	api.GET("/ws", middlewares.AuthRequired(), gin.WrapF(broadcast.Handler))
@@ -48,30 +161,96 @@ func main() {
 
 	// auth
 	auth := api.Group("/auth")
-	auth.POST("/register", handlers.Register)
-	auth.POST("/login", handlers.Login)
+	auth.POST("/register", registerLimit, handlers.Register)
+	auth.POST("/login", loginLimit, handlers.Login)
 	auth.GET("/profile", middlewares.AuthRequired(), handlers.Profile)
 
 	// speedtest
-	api.POST("/speedtest", handlers.SpeedtestCreate)
+	api.POST("/speedtest", ingestIPLimit, middlewares.IngestKeyRequired(models.IngestScopeSpeedtest), speedtestKeyLimit, middlewares.DecodeBody(ingestBodyLimit), handlers.SpeedtestCreate)
 	speedtest := api.Group("/speedtest", middlewares.AuthRequired(), middlewares.PermissionsRequired())
 	speedtest.GET("/", handlers.SpeedtestList)
 	speedtest.GET("/tranding", handlers.SpeedtestTrending)
+	speedtest.GET("/export", handlers.SpeedtestExport)
 
 	// logs
-	api.POST("/logs", handlers.LogCreate)
+	api.POST("/logs", ingestIPLimit, middlewares.IngestKeyRequired(models.IngestScopeLogs), logsKeyLimit, middlewares.DecodeStream(ingestBodyLimit, ingestStreamLimit), handlers.LogCreate)
 	logs := api.Group("/logs", middlewares.AuthRequired(), middlewares.PermissionsRequired())
 	logs.GET("/", handlers.LogList)
 	logs.GET("/stats", handlers.LogStats)
 	logs.GET("/count", handlers.LogCount)
+	logs.GET("/latency", handlers.LogLatency)
+	logs.GET("/latency/histogram", handlers.LogLatencyHistogram)
+	logs.GET("/latency/heatmap", handlers.LogLatencyHeatmap)
+	logs.GET("/breakdown", handlers.LogBreakdown)
+	logs.GET("/export", handlers.LogExport)
+	logs.GET("/search", handlers.LogSearch)
+	logs.GET("/:req_id", handlers.LogGet)
+	logs.GET("/:req_id/data", handlers.LogData)
+	logs.GET("/:req_id/timeline", handlers.LogTimeline)
+
+	// events
+	events := api.Group("/events", middlewares.AuthRequired(), middlewares.PermissionsRequired())
+	events.GET("/", handlers.EventList)
+
+	// OTLP/HTTP logs receiver, unwrapped
+	r.POST("/v1/logs", ingestIPLimit, middlewares.IngestKeyRequired(models.IngestScopeLogs), logsKeyLimit, middlewares.DecodeBody(ingestBodyLimit), handlers.OTLPLogs)
+
+	// ingestion pipeline
+	ingestion := api.Group("/ingest", middlewares.AuthRequired(), middlewares.PermissionsRequired())
+	ingestion.GET("/stats", handlers.IngestStats)
+	ingestion.GET("/spool", handlers.IngestSpool)
+
+	// redaction
+	redaction := api.Group("/redact", middlewares.AuthRequired(), middlewares.PermissionsRequired())
+	redaction.POST("/preview", handlers.RedactPreview)
+
+	// dead letters
+	deadLetters := api.Group("/deadletters", middlewares.AuthRequired(), middlewares.PermissionsRequired())
+	deadLetters.GET("/", handlers.DeadLetterList)
+	deadLetters.GET("/:id", handlers.DeadLetterGet)
+	deadLetters.DELETE("/:id", handlers.DeadLetterDelete)
+	deadLetters.POST("/:id/resubmit", handlers.DeadLetterResubmit)
+
+	// route templates
+	routeTemplates := api.Group("/routes", middlewares.AuthRequired(), middlewares.PermissionsRequired())
+	routeTemplates.GET("/", handlers.RouteTemplateList)
+	routeTemplates.POST("/", handlers.RouteTemplateCreate)
+	routeTemplates.DELETE("/:id", handlers.RouteTemplateDelete)
+	routeTemplates.GET("/preview", handlers.RoutePreview)
+	routeTemplates.POST("/renormalize", handlers.RouteRenormalize(root))
+	routeTemplates.GET("/renormalize", handlers.RouteRenormalizeStatus)
+
+	// ingest keys
+	keys := api.Group("/keys", middlewares.AuthRequired(), middlewares.PermissionsRequired())
+	keys.GET("/", handlers.IngestKeyList)
+	keys.POST("/", handlers.IngestKeyCreate)
+	keys.DELETE("/:id", handlers.IngestKeyRevoke)
 
 	srv := &http.Server{
 		Addr:              ":1337",
 		Handler:           r,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
-	log.Println("listening :1337")
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("server: %v", err)
+	go func() {
+		log.Println("listening :1337")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server: %v", err)
+		}
+	}()
+
+	<-root.Done()
+	log.Println("shutting down")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+	syslog.Stop()
+	if err := ingest.Stop(shutdownCtx); err != nil {
+		log.Printf("ingest queue flush: %v", err)
 	}
+	spool.Stop()
+	broadcast.Close()
 }
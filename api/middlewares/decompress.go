@@ -0,0 +1,93 @@
+package middlewares
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"metrics/constraints"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DecodeBody decompresses gzip and zstd request bodies and caps the decoded
+// body at limit bytes, so a small compressed payload cannot expand without
+// bound. Reads past the limit fail with *http.MaxBytesError, see
+// BodyTooLarge.
+func DecodeBody(limit int64) gin.HandlerFunc {
+	return DecodeStream(limit, limit)
+}
+
+// DecodeStream is DecodeBody with streamLimit for NDJSON bodies, which are
+// read and stored a line at a time with every line capped, so a backfill is
+// only bounded by streamLimit. Zstd windows stay bounded by limit.
+func DecodeStream(limit, streamLimit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := c.Request.Body
+		encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding")))
+
+		switch encoding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_body_encoding"})
+				return
+			}
+			body = readCloser{Reader: zr, close: func() error {
+				zr.Close()
+				return c.Request.Body.Close()
+			}}
+		case "zstd":
+			// a frame may declare a window far larger than its content;
+			// refuse windows the decoded body could never need
+			window := uint64(max(min(limit, zstd.MaxWindowSize), zstd.MinWindowSize))
+			zr, err := zstd.NewReader(body,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(window),
+				zstd.WithDecoderMaxMemory(window))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_body_encoding"})
+				return
+			}
+			body = readCloser{Reader: zr, close: func() error {
+				zr.Close()
+				return c.Request.Body.Close()
+			}}
+		default:
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported_content_encoding"})
+			return
+		}
+
+		if encoding != "" && encoding != "identity" {
+			c.Request.Header.Del("Content-Encoding")
+			c.Request.Header.Del("Content-Length")
+			c.Request.ContentLength = -1
+		}
+		if c.ContentType() == constraints.NDJSON {
+			c.Request.Body = http.MaxBytesReader(c.Writer, body, streamLimit)
+		} else {
+			c.Request.Body = http.MaxBytesReader(c.Writer, body, limit)
+		}
+		c.Next()
+	}
+}
+
+// BodyTooLarge reports whether err came from reading past the DecodeBody
+// limit, or from a zstd frame asking for a larger window.
+func BodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe) || errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded)
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"metrics/constraints"
+	"metrics/models"
+	"metrics/storage"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// lastUsed writes are throttled so that a busy shipper does not turn
+	// every ingest call into an extra update.
+	ingestKeyTouchEvery = time.Minute
+	// a key missing from the cache is looked up within this, rather than
+	// waiting out server selection while Mongo is down
+	ingestKeyLookupTimeout = 2 * time.Second
+)
+
+func IngestKeyRequired(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := strings.TrimSpace(c.GetHeader(constraints.IngestKey))
+		if secret == "" {
+			if v, ok := strings.CutPrefix(c.GetHeader(constraints.Authorization), "Bearer "); ok {
+				secret = strings.TrimSpace(v)
+			}
+		}
+		if secret == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "no ingest key"})
+			return
+		}
+
+		hash := models.HashIngestKey(secret)
+		key, ok := cachedIngestKey(hash)
+		if !ok {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), ingestKeyLookupTimeout)
+			k, err := storage.IngestKeyGetByHash(ctx, hash)
+			cancel()
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid ingest key"})
+				return
+			}
+			if err != nil {
+				// the key may well be valid; shippers retry or spool on 503
+				c.Header("Retry-After", "5")
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "ingest key lookup failed"})
+				return
+			}
+			key = *k
+			CacheIngestKey(key)
+		}
+		if key.Revoked() {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid ingest key"})
+			return
+		}
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "ingest key scope"})
+			return
+		}
+
+		now := time.Now().UTC()
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > ingestKeyTouchEvery {
+			key.LastUsedAt = &now
+			CacheIngestKey(key)
+			go func(k models.IngestKey) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = storage.IngestKeyTouch(ctx, k.ID, now)
+			}(key)
+		}
+
+		c.Set("ingest_key", key)
+		c.Next()
+	}
+}
@@ -0,0 +1,73 @@
+package middlewares
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"metrics/models"
+	"metrics/storage"
+)
+
+// Ingest keys are cached by hash, so ingestion does not need the database
+// to authenticate a known key: when Mongo is down the request still gets
+// through to the spool. The cache is reloaded periodically, which picks up
+// keys revoked through another instance.
+var ingestKeyCache = struct {
+	sync.RWMutex
+	byHash map[string]models.IngestKey
+}{byHash: map[string]models.IngestKey{}}
+
+func cachedIngestKey(hash string) (models.IngestKey, bool) {
+	ingestKeyCache.RLock()
+	defer ingestKeyCache.RUnlock()
+	k, ok := ingestKeyCache.byHash[hash]
+	return k, ok
+}
+
+// CacheIngestKey stores k in the cache, for instance right after it was
+// revoked so that it is refused at once.
+func CacheIngestKey(k models.IngestKey) {
+	ingestKeyCache.Lock()
+	ingestKeyCache.byHash[k.Hash] = k
+	ingestKeyCache.Unlock()
+}
+
+// LoadIngestKeys replaces the cache with the keys in the database.
+func LoadIngestKeys(ctx context.Context) error {
+	list, err := storage.IngestKeyList(ctx)
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]models.IngestKey, len(list))
+	for _, k := range list {
+		byHash[k.Hash] = k
+	}
+	ingestKeyCache.Lock()
+	ingestKeyCache.byHash = byHash
+	ingestKeyCache.Unlock()
+	return nil
+}
+
+// WatchIngestKeys reloads the cache every interval until ctx is done. A
+// failed reload keeps the keys cached so far.
+func WatchIngestKeys(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			if err := LoadIngestKeys(lctx); err != nil {
+				log.Printf("ingest keys: reload: %v", err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"metrics/models"
+	"metrics/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit is a token bucket of Limit requests refilled evenly over Period,
+// kept per value of Key. Requests for which Key returns "" are not limited
+// by this bucket.
+type RateLimit struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	Key    func(c *gin.Context) string
+}
+
+func (l RateLimit) rate() float64 {
+	return float64(l.Limit) / l.Period.Seconds()
+}
+
+// RateKeyIP keys by client address.
+func RateKeyIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// RateKeyIngestKey keys by the ingest key set by IngestKeyRequired.
+func RateKeyIngestKey(c *gin.Context) string {
+	v, ok := c.Get("ingest_key")
+	if !ok {
+		return ""
+	}
+	k, _ := v.(models.IngestKey)
+	return k.ID.Hex()
+}
+
+// RateKeyEmail keys by the "email" field of a JSON body. The body is put back
+// for the handler.
+func RateKeyEmail(c *gin.Context) string {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(payload.Email))
+}
+
+// RateLimited applies every limit to the request and rejects it with 429 as
+// soon as one bucket is empty. The RateLimit-* headers describe the most
+// constrained bucket.
+func RateLimited(limits ...RateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var (
+			tightest decision
+			policy   RateLimit
+			seen     bool
+		)
+		for _, l := range limits {
+			key := l.Key(c)
+			if key == "" {
+				continue
+			}
+			d := take(c, l, l.Name+":"+key)
+			if !seen || d.remaining < tightest.remaining || !d.allowed {
+				tightest, policy, seen = d, l, true
+			}
+			if !d.allowed {
+				break
+			}
+		}
+		if !seen {
+			c.Next()
+			return
+		}
+
+		h := c.Writer.Header()
+		h.Set("RateLimit-Policy", strconv.Itoa(policy.Limit)+";w="+strconv.Itoa(int(policy.Period.Seconds())))
+		h.Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(tightest.remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(seconds(tightest.reset)))
+		if !tightest.allowed {
+			h.Set("Retry-After", strconv.Itoa(seconds(tightest.retryAfter)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate_limited"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type decision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next token
+}
+
+func decide(l RateLimit, tokens float64, allowed bool) decision {
+	rate := l.rate()
+	d := decision{
+		allowed:   allowed,
+		remaining: int(math.Floor(tokens)),
+		reset:     time.Duration((float64(l.Limit) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		d.retryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return d
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+var (
+	sharedRateLimits bool
+	sharedFailLogged time.Time
+	sharedFailMu     sync.Mutex
+)
+
+// UseSharedRateLimits keeps buckets in Mongo so that limits hold across
+// replicas. When Mongo cannot be reached requests fall back to the local
+// buckets rather than failing.
+func UseSharedRateLimits() {
+	sharedRateLimits = true
+}
+
+func take(c *gin.Context, l RateLimit, key string) decision {
+	if sharedRateLimits {
+		tokens, allowed, err := storage.RateLimitTake(c.Request.Context(), key, l.Limit, l.rate(), l.Period)
+		if err == nil {
+			return decide(l, tokens, allowed)
+		}
+		sharedFailMu.Lock()
+		if time.Since(sharedFailLogged) > time.Minute {
+			sharedFailLogged = time.Now()
+			log.Printf("ratelimit: shared state unavailable, using local buckets: %v", err)
+		}
+		sharedFailMu.Unlock()
+	}
+	return localBuckets.take(l, key, time.Now())
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	period time.Duration
+}
+
+type bucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+var localBuckets = &bucketStore{buckets: map[string]*bucket{}}
+
+func (s *bucketStore) take(l RateLimit, key string, now time.Time) decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Limit), at: now, period: l.Period}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Limit), b.tokens+now.Sub(b.at).Seconds()*l.rate())
+	b.at = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return decide(l, b.tokens, allowed)
+}
+
+// sweep drops buckets idle for longer than their period; they would be full
+// again anyway.
+func (s *bucketStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for k, b := range s.buckets {
+		if now.Sub(b.at) > b.period {
+			delete(s.buckets, k)
+		}
+	}
+}
@@ -10,13 +10,24 @@ import (
 
 type responseBodyWriter struct {
 	gin.ResponseWriter
-	body *bytes.Buffer
+	body      *bytes.Buffer
+	streaming bool
 }
 
 func (rbw responseBodyWriter) Write(b []byte) (int, error) {
 	return rbw.body.Write(b)
 }
 
+// StreamResponse takes the request out of ResponseWrapper: from here on the
+// handler writes straight to the client, without the envelope, instead of
+// into a buffer. Errors answered before the call are still wrapped.
+func StreamResponse(c *gin.Context) {
+	if rbw, ok := c.Writer.(*responseBodyWriter); ok {
+		rbw.streaming = true
+		c.Writer = rbw.ResponseWriter
+	}
+}
+
 func ResponseWrapper() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		rbw := &responseBodyWriter{body: &bytes.Buffer{}, ResponseWriter: c.Writer}
@@ -24,6 +35,10 @@ func ResponseWrapper() gin.HandlerFunc {
 
 		c.Next()
 
+		if rbw.streaming {
+			return
+		}
+
 		var data interface{}
 
 		if err := json.Unmarshal(rbw.body.Bytes(), &data); err != nil {
@@ -43,6 +58,13 @@ func ResponseWrapper() gin.HandlerFunc {
 			"status":    status,
 			"data":      data,
 		}
+		// cursors of paged listings
+		if next := c.GetString("next"); next != "" {
+			response["next"] = next
+		}
+		if prev := c.GetString("prev"); prev != "" {
+			response["prev"] = prev
+		}
 
 		c.Writer = rbw.ResponseWriter
 		c.Header("Content-Type", "application/json")
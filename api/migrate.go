@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"metrics/storage"
+)
+
+// runMigrateURLs fills host, scheme, pathname and query on logs stored before
+// ingest started decomposing the path. It only touches documents without a
+// pathname, so it can be interrupted and re-run.
+func runMigrateURLs(args []string) int {
+	fs := flag.NewFlagSet("migrate-urls", flag.ExitOnError)
+	batchSize := fs.Int("batch", 1000, "updates per bulk write")
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	disconnect, ok := commandStorage(ctx)
+	if !ok {
+		return 1
+	}
+	defer disconnect()
+
+	n, err := storage.LogDecomposePaths(ctx, *batchSize, func(done int64) {
+		log.Printf("migrate-urls: %d logs updated", done)
+	})
+	if err != nil {
+		log.Printf("migrate-urls: %v (after %d logs)", err, n)
+		return 1
+	}
+	log.Printf("migrate-urls: done, %d logs updated", n)
+	return 0
+}
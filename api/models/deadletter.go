@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DeadLetterLogs      = "logs"
+	DeadLetterSpeedtest = "speedtest"
+)
+
+// DeadLetter is a rejected ingestion payload kept for debugging. Payload is
+// cut at the configured cap; Size is the length that was received.
+type DeadLetter struct {
+	ID            primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Kind          string              `json:"kind" bson:"kind"`
+	Reason        string              `json:"reason" bson:"reason"`
+	Errors        []string            `json:"errors,omitempty" bson:"errors,omitempty"`
+	ContentType   string              `json:"contentType,omitempty" bson:"contentType,omitempty"`
+	Payload       string              `json:"payload,omitempty" bson:"payload"`
+	Size          int                 `json:"size" bson:"size"`
+	Truncated     bool                `json:"truncated" bson:"truncated"`
+	IP            string              `json:"ip" bson:"ip"`
+	IngestKeyID   *primitive.ObjectID `json:"ingestKeyId,omitempty" bson:"ingestKeyId,omitempty"`
+	Source        string              `json:"source,omitempty" bson:"source,omitempty"`
+	ReceivedAt    time.Time           `json:"receivedAt" bson:"receivedAt"`
+	ResubmittedAt *time.Time          `json:"resubmittedAt,omitempty" bson:"resubmittedAt,omitempty"`
+	ResubmittedBy *primitive.ObjectID `json:"resubmittedBy,omitempty" bson:"resubmittedBy,omitempty"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is a non-HTTP message from a log source such as syslog, kept so that
+// nothing a source sends is silently dropped. EventID, when the source can
+// derive one, is unique, so a retried write does not store the event twice.
+type Event struct {
+	ID         primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	EventID    string                 `json:"eventId,omitempty" bson:"event_id,omitempty"`
+	Timestamp  time.Time              `json:"timestamp" bson:"timestamp"`
+	ReceivedAt time.Time              `json:"receivedAt" bson:"receivedAt"`
+	Source     string                 `json:"source" bson:"source"`
+	Host       string                 `json:"host,omitempty" bson:"host,omitempty"`
+	App        string                 `json:"app,omitempty" bson:"app,omitempty"`
+	ProcID     string                 `json:"procId,omitempty" bson:"procId,omitempty"`
+	MsgID      string                 `json:"msgId,omitempty" bson:"msgId,omitempty"`
+	Facility   int                    `json:"facility" bson:"facility"`
+	Severity   string                 `json:"severity" bson:"severity"`
+	Message    string                 `json:"message" bson:"message"`
+	Structured map[string]interface{} `json:"structured,omitempty" bson:"structured,omitempty"`
+}
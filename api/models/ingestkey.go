@@ -0,0 +1,67 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	IngestScopeLogs      = "logs"
+	IngestScopeSpeedtest = "speedtest"
+)
+
+const ingestKeyPrefix = "mik_"
+
+var IngestScopes = []string{IngestScopeLogs, IngestScopeSpeedtest}
+
+type IngestKey struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Source     string             `json:"source" bson:"source"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	Hash       string             `json:"-" bson:"hash"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	CreatedBy  primitive.ObjectID `json:"createdBy" bson:"createdBy"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	LastUsedAt *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+func (k *IngestKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *IngestKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// NewIngestKeySecret returns a fresh plaintext key. Only its hash is stored,
+// so the caller must hand the plaintext to the user right away.
+func NewIngestKeySecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return ingestKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func HashIngestKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func IngestKeyDisplayPrefix(secret string) string {
+	if len(secret) <= len(ingestKeyPrefix)+6 {
+		return secret
+	}
+	return secret[:len(ingestKeyPrefix)+6]
+}
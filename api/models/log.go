@@ -9,16 +9,29 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Log struct {
-	ReqID     string                 `json:"req_id" bson:"req_id"`
-	Timestamp time.Time              `json:"timestamp" bson:"timestamp" validate:"required"`
-	Status    int                    `json:"status" bson:"status" validate:"required"`
-	Took      int                    `json:"took" bson:"took"`
-	Path      string                 `json:"path" bson:"path" validate:"required"`
-	Method    string                 `json:"method" bson:"method" validate:"required"`
-	Data      map[string]interface{} `json:"data,omitempty" bson:"data,omitempty"`
+	ID         primitive.ObjectID     `json:"-" bson:"_id,omitempty"`
+	ReqID      string                 `json:"req_id" bson:"req_id"`
+	Timestamp  time.Time              `json:"timestamp" bson:"timestamp" validate:"required"`
+	Status     int                    `json:"status" bson:"status" validate:"required"`
+	Took       int                    `json:"took" bson:"took"`
+	Path       string                 `json:"path" bson:"path" validate:"required"`
+	Method     string                 `json:"method" bson:"method" validate:"required"`
+	Host       string                 `json:"host,omitempty" bson:"host,omitempty"`
+	Scheme     string                 `json:"scheme,omitempty" bson:"scheme,omitempty"`
+	Pathname   string                 `json:"pathname,omitempty" bson:"pathname,omitempty"`
+	Query      string                 `json:"query,omitempty" bson:"query,omitempty"`
+	Route      string                 `json:"route,omitempty" bson:"route,omitempty"`
+	SampleRate float64                `json:"sample_rate,omitempty" bson:"sample_rate,omitempty"`
+	ParentID   string                 `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+	TraceID    string                 `json:"trace_id,omitempty" bson:"trace_id,omitempty"`
+	Source     string                 `json:"source,omitempty" bson:"source,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty" bson:"data,omitempty"`
+	Search     string                 `json:"-" bson:"search"`                              // see IndexSearch; stored empty too
+	HasData    bool                   `json:"has_data,omitempty" bson:"has_data,omitempty"` // set by list projections
 }
 
 type StatusRecord struct {
@@ -29,7 +42,8 @@ type StatusRecord struct {
 }
 
 type LogChartPoint struct {
-	Date int64 `json:"date" bson:"date"`
+	Date  int64  `json:"date" bson:"date"`
+	Group string `json:"group,omitempty" bson:"group,omitempty"`
 	StatusRecord
 }
 
@@ -95,28 +109,59 @@ func (l *Log) EnsureReqID() {
 	}
 }
 
-func LogsFromJSON(b []byte) ([]Log, error) {
+// LogsFromJSON decodes a single entry or an array of entries. Entries that
+// fail validation do not fail the batch: their errors are returned at the
+// same index, so the caller can store the rest.
+func LogsFromJSON(b []byte) ([]Log, []error, error) {
 	var batch []Log
 	if err := json.Unmarshal(b, &batch); err == nil {
 		if len(batch) == 0 {
-			return nil, errors.New("empty_array")
+			return nil, nil, errors.New("empty_array")
 		}
+		invalid := make([]error, len(batch))
 		for i := range batch {
 			batch[i].EnsureReqID()
-			if err := batch[i].Validate(); err != nil {
-				return nil, err
-			}
+			invalid[i] = batch[i].Validate()
 		}
-		return batch, nil
+		return batch, invalid, nil
 	}
 	var one Log
 	if err := json.Unmarshal(b, &one); err != nil {
-		return nil, errors.New("invalid_json")
+		return nil, nil, errors.New("invalid_json")
 	}
+	one.EnsureReqID()
+	return []Log{one}, []error{one.Validate()}, nil
+}
+
+const (
+	LogItemQueued    = "queued"
+	LogItemInserted  = "inserted"
+	LogItemSpooled   = "spooled"
+	LogItemDuplicate = "duplicate"
+	LogItemInvalid   = "invalid"
+	LogItemFailed    = "failed"
+	LogItemSampled   = "sampled"
+)
+
+type LogItemResult struct {
+	Index  int    `json:"index"`
+	ReqID  string `json:"req_id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LogFromJSON decodes a single log entry, as sent on one line of an NDJSON
+// stream.
+func LogFromJSON(b []byte) (Log, error) {
+	var one Log
+	if err := json.Unmarshal(b, &one); err != nil {
+		return Log{}, errors.New("invalid_json")
+	}
+	one.EnsureReqID()
 	if err := one.Validate(); err != nil {
-		return nil, err
+		return Log{}, err
 	}
-	return []Log{one}, nil
+	return one, nil
 }
 
 type LogSelectOptions struct {
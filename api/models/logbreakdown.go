@@ -0,0 +1,22 @@
+package models
+
+// BreakdownRow is one group of a log breakdown. Errors counts 5xx
+// responses. P95 and Mean are of Took in milliseconds; P95 is null on the
+// other row, where it cannot be derived from the folded groups.
+type BreakdownRow struct {
+	Key       string   `json:"key" bson:"_id"`
+	Count     int64    `json:"count" bson:"count"`
+	Errors    int64    `json:"errors" bson:"errors"`
+	ErrorRate float64  `json:"error_rate" bson:"error_rate"`
+	P95       *float64 `json:"p95" bson:"p95"`
+	Mean      *float64 `json:"mean" bson:"mean"`
+	// Groups is the number of groups folded into the other row.
+	Groups int64 `json:"groups,omitempty" bson:"groups,omitempty"`
+}
+
+type Breakdown struct {
+	By    string         `json:"by"`
+	Sort  string         `json:"sort"`
+	Rows  []BreakdownRow `json:"rows"`
+	Other *BreakdownRow  `json:"other,omitempty"`
+}
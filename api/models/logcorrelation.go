@@ -0,0 +1,60 @@
+package models
+
+import "strings"
+
+// data keys that carry the id of the request that caused this one
+var parentIDKeys = []string{"parent_id", "parentId", "request_id", "requestId", "x_request_id"}
+
+var traceIDKeys = []string{"trace_id", "traceId"}
+
+// Correlate fills ParentID and TraceID from well-known Data keys and request
+// headers when the sender did not set them: nginx passes its $request_id
+// upstream as X-Request-ID, and W3C traceparent carries the trace.
+func (l *Log) Correlate() {
+	headers := l.requestHeaders()
+
+	if l.ParentID == "" {
+		l.ParentID = firstString(l.Data, parentIDKeys...)
+	}
+	if l.ParentID == "" {
+		l.ParentID = firstString(headers, "x-request-id")
+	}
+	if l.ParentID == l.ReqID {
+		l.ParentID = ""
+	}
+
+	if l.TraceID == "" {
+		l.TraceID = strings.ToLower(firstString(l.Data, traceIDKeys...))
+	}
+	if l.TraceID == "" {
+		l.TraceID = traceparentTraceID(firstString(headers, "traceparent"))
+	}
+}
+
+func (l *Log) requestHeaders() map[string]interface{} {
+	req, _ := l.Data["request"].(map[string]interface{})
+	h, _ := req["headers"].(map[string]interface{})
+	if h == nil {
+		h, _ = l.Data["headers"].(map[string]interface{})
+	}
+	return h
+}
+
+func firstString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if s, ok := m[k].(string); ok && strings.TrimSpace(s) != "" {
+			return strings.TrimSpace(s)
+		}
+	}
+	return ""
+}
+
+// traceparentTraceID extracts the trace id of a version-00 traceparent
+// header: 00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>.
+func traceparentTraceID(v string) string {
+	parts := strings.Split(strings.ToLower(v), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0123456789abcdef") != "" || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return parts[1]
+}
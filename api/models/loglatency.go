@@ -0,0 +1,34 @@
+package models
+
+// LatencyPoint summarises Took, in milliseconds, over one stats bucket.
+// Percentiles and Mean are nil for buckets without logs.
+type LatencyPoint struct {
+	Date  int64    `json:"date" bson:"date"`
+	Group string   `json:"group,omitempty" bson:"group,omitempty"`
+	Count int64    `json:"count" bson:"count"`
+	Mean  *float64 `json:"mean" bson:"mean"`
+	P50   *float64 `json:"p50" bson:"p50"`
+	P90   *float64 `json:"p90" bson:"p90"`
+	P95   *float64 `json:"p95" bson:"p95"`
+	P99   *float64 `json:"p99" bson:"p99"`
+	Max   *float64 `json:"max" bson:"max"`
+}
+
+// LatencyHistogram counts logs per Took bin. Bin i covers
+// [Edges[i], Edges[i+1]) and the last bin is open-ended; logs faster than
+// Edges[0] are not counted.
+type LatencyHistogram struct {
+	Edges  []int64 `json:"edges"`
+	Counts []int64 `json:"counts"`
+}
+
+// LatencyHeatmap is a LatencyHistogram per stats bucket.
+type LatencyHeatmap struct {
+	Edges []int64             `json:"edges"`
+	Rows  []LatencyHeatmapRow `json:"rows"`
+}
+
+type LatencyHeatmapRow struct {
+	Date   int64   `json:"date"`
+	Counts []int64 `json:"counts"`
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxSearchText caps the text indexed per log.
+const maxSearchText = 16 << 10
+
+// data keys whose values are indexed for full-text search, as dotted paths
+var searchKeys = []string{
+	"body", "request.body", "response.body", "request_body", "response_body",
+	"error", "err", "message", "msg", "exception",
+	"http_user_agent", "http_referer",
+}
+
+// SearchHeaders are the request and response headers indexed for search.
+var SearchHeaders = []string{"user-agent", "referer"}
+
+var headerPaths = []string{"headers", "request.headers", "response.headers"}
+
+// IndexSearch sets Search from the textual parts of Data. Path is indexed
+// on its own, so it is not repeated here. It runs after redaction so masked
+// values never reach the index.
+func (l *Log) IndexSearch() {
+	l.Search = SearchText(l.Data)
+}
+
+// SearchText collects the strings of the search keys and headers of data,
+// nested values included, up to maxSearchText bytes.
+func SearchText(data map[string]interface{}) string {
+	var b strings.Builder
+	add := func(s string) {
+		s = strings.TrimSpace(s)
+		if s == "" || b.Len() >= maxSearchText {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		if room := maxSearchText - b.Len(); len(s) > room {
+			s = s[:room]
+			for len(s) > 0 && !utf8.ValidString(s) {
+				s = s[:len(s)-1]
+			}
+		}
+		b.WriteString(s)
+	}
+
+	for _, k := range searchKeys {
+		if v, ok := dataPath(data, k); ok {
+			walkStrings(v, add)
+		}
+	}
+	for _, p := range headerPaths {
+		v, _ := dataPath(data, p)
+		h := asMap(v)
+		for name, hv := range h {
+			for _, want := range SearchHeaders {
+				if strings.EqualFold(name, want) {
+					walkStrings(hv, add)
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+func dataPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = data
+	for _, seg := range strings.Split(path, ".") {
+		m := asMap(cur)
+		if m == nil {
+			return nil, false
+		}
+		v, ok := m[seg]
+		if !ok {
+			return nil, false
+		}
+		cur = v
+	}
+	return cur, true
+}
+
+// asMap accepts documents as decoded from JSON or from BSON.
+func asMap(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return x
+	case primitive.M:
+		return x
+	case primitive.D:
+		return x.Map()
+	}
+	return nil
+}
+
+func walkStrings(v interface{}, fn func(string)) {
+	switch x := v.(type) {
+	case string:
+		fn(x)
+	case []interface{}:
+		for _, e := range x {
+			walkStrings(e, fn)
+		}
+	case primitive.A:
+		for _, e := range x {
+			walkStrings(e, fn)
+		}
+	default:
+		if m := asMap(v); m != nil {
+			for _, e := range m {
+				walkStrings(e, fn)
+			}
+		}
+	}
+}
+
+// Highlight is the best window of a field around the search terms, split
+// into matching and non-matching parts so clients can mark the matches
+// without parsing markup.
+type Highlight struct {
+	Field string          `json:"field"`
+	Parts []HighlightPart `json:"parts"`
+}
+
+type HighlightPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+const highlightWindow = 160
+
+// SearchTerms returns the words and phrases of a $text search string that
+// a result should contain; negated terms are left out.
+func SearchTerms(q string) []string {
+	var out []string
+	for len(q) > 0 {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if q == "" {
+			break
+		}
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				end = len(q) - 1
+			}
+			if phrase := strings.TrimSpace(q[1 : end+1]); phrase != "" {
+				out = append(out, phrase)
+			}
+			q = q[min(end+2, len(q)):]
+			continue
+		}
+		end := strings.IndexFunc(q, unicode.IsSpace)
+		if end < 0 {
+			end = len(q)
+		}
+		word := q[:end]
+		q = q[end:]
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		if word = strings.Trim(word, `"`); word != "" {
+			out = append(out, word)
+		}
+	}
+	return out
+}
+
+// HighlightText finds terms in text, case-insensitively, and returns the
+// window around the first match. ok is false when nothing matches.
+func HighlightText(field, text string, terms []string) (h Highlight, ok bool) {
+	lower := strings.ToLower(text)
+	type span struct{ start, end int }
+	var spans []span
+	for _, t := range terms {
+		t = strings.ToLower(t)
+		for i := 0; t != ""; {
+			j := strings.Index(lower[i:], t)
+			if j < 0 {
+				break
+			}
+			spans = append(spans, span{i + j, i + j + len(t)})
+			i += j + len(t)
+		}
+	}
+	if len(spans) == 0 || len(lower) != len(text) {
+		// ToLower changed byte offsets; nothing safe to mark
+		return h, false
+	}
+
+	first := spans[0]
+	for _, s := range spans {
+		if s.start < first.start {
+			first = s
+		}
+	}
+	from := max(0, first.start-highlightWindow/4)
+	to := min(len(text), from+highlightWindow)
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	marks := make([]bool, to-from)
+	for _, s := range spans {
+		for i := max(s.start, from); i < min(s.end, to); i++ {
+			marks[i-from] = true
+		}
+	}
+
+	h.Field = field
+	if from > 0 {
+		h.Parts = append(h.Parts, HighlightPart{Text: "…"})
+	}
+	start := 0
+	for i := 1; i <= len(marks); i++ {
+		if i == len(marks) || marks[i] != marks[start] {
+			h.Parts = append(h.Parts, HighlightPart{Text: text[from+start : from+i], Match: marks[start]})
+			start = i
+		}
+	}
+	if to < len(text) {
+		h.Parts = append(h.Parts, HighlightPart{Text: "…"})
+	}
+	return h, true
+}
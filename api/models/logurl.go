@@ -0,0 +1,71 @@
+package models
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// URLParts is the decomposition of Log.Path into the indexed fields.
+type URLParts struct {
+	Host     string
+	Scheme   string
+	Pathname string
+	Query    string
+}
+
+// SplitURL decomposes the path as sent by the loggers: usually a full
+// scheme://host/uri?query URL, sometimes only the request URI. The host is
+// lowercased and loses the scheme's default port so that one virtual host
+// groups as one value.
+func SplitURL(raw string) URLParts {
+	var p URLParts
+	u, err := url.Parse(raw)
+	if err != nil {
+		// keep what can be recovered from malformed escapes
+		p.Pathname, p.Query, _ = strings.Cut(raw, "?")
+		if i := strings.Index(p.Pathname, "://"); i >= 0 {
+			p.Scheme = strings.ToLower(p.Pathname[:i])
+			rest := p.Pathname[i+3:]
+			host, path, _ := strings.Cut(rest, "/")
+			p.Host = normalizeHost(host, p.Scheme)
+			p.Pathname = "/" + path
+		}
+		if p.Pathname == "" {
+			p.Pathname = "/"
+		}
+		return p
+	}
+
+	p.Scheme = strings.ToLower(u.Scheme)
+	p.Host = normalizeHost(u.Host, p.Scheme)
+	p.Pathname = u.EscapedPath()
+	if p.Pathname == "" {
+		p.Pathname = "/"
+	}
+	p.Query = u.RawQuery
+	return p
+}
+
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+			host = h
+			if strings.Contains(h, ":") {
+				host = "[" + h + "]"
+			}
+		}
+	}
+	return host
+}
+
+// DecomposePath fills Host, Scheme, Pathname and Query from Path. Path itself
+// is left untouched.
+func (l *Log) DecomposePath() {
+	p := SplitURL(l.Path)
+	l.Host = p.Host
+	l.Scheme = p.Scheme
+	l.Pathname = p.Pathname
+	l.Query = p.Query
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RouteTemplate collapses matching paths into one route, e.g.
+// /api/users/:id/orders/:id. A ":name" segment matches any single segment and
+// a trailing "*" matches the rest of the path. Host, when set, limits the
+// template to that virtual host.
+type RouteTemplate struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Pattern   string             `json:"pattern" bson:"pattern"`
+	Host      string             `json:"host,omitempty" bson:"host,omitempty"`
+	CreatedBy primitive.ObjectID `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+func (t *RouteTemplate) Validate() error {
+	if !strings.HasPrefix(t.Pattern, "/") {
+		return errors.New("pattern_must_start_with_slash")
+	}
+	segs := strings.Split(strings.Trim(t.Pattern, "/"), "/")
+	for i, s := range segs {
+		switch {
+		case s == "" && len(segs) > 1:
+			return errors.New("pattern_empty_segment")
+		case s == "*" && i != len(segs)-1:
+			return errors.New("pattern_wildcard_not_last")
+		case s == ":":
+			return errors.New("pattern_unnamed_param")
+		}
+	}
+	return nil
+}
@@ -70,5 +70,6 @@ type Speedtest struct {
 	Timestamp  time.Time          `json:"timestamp" binding:"required"`
 	Type       string             `json:"type" binding:"required"`
 	Upload     Upload             `json:"upload" binding:"required"`
+	Source     string             `json:"source,omitempty" bson:"source,omitempty"`
 	ReceivedAt *time.Time         `json:"-" bson:"receivedAt,omitempty"`
 }
@@ -0,0 +1,443 @@
+package otlp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"metrics/models"
+
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeJSON     = "application/json"
+)
+
+// Decode parses an OTLP/HTTP export request in either encoding.
+// ExportLogsServiceRequest has the same shape as LogsData, which keeps the
+// gRPC service packages out of the build. OTLP/JSON carries trace and span
+// ids as hex rather than the base64 protojson expects, so those are rewritten
+// before unmarshalling.
+func Decode(body []byte, contentType string) (*logspb.LogsData, error) {
+	req := &logspb.LogsData{}
+	switch contentType {
+	case ContentTypeProtobuf:
+		if err := proto.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+	case ContentTypeJSON:
+		var raw interface{}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, err
+		}
+		hexIDsToBase64(raw)
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, req); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported_content_type")
+	}
+	return req, nil
+}
+
+// EncodeResponse renders an ExportLogsServiceResponse in the encoding of the
+// request. The message is tiny, so it is written by hand.
+func EncodeResponse(rejected int64, message, contentType string) ([]byte, error) {
+	if contentType == ContentTypeProtobuf {
+		if rejected == 0 && message == "" {
+			return []byte{}, nil
+		}
+		var partial []byte
+		if rejected != 0 {
+			partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+			partial = protowire.AppendVarint(partial, uint64(rejected))
+		}
+		if message != "" {
+			partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+			partial = protowire.AppendString(partial, message)
+		}
+		out := protowire.AppendTag(nil, 1, protowire.BytesType)
+		return protowire.AppendBytes(out, partial), nil
+	}
+
+	resp := map[string]interface{}{}
+	if rejected > 0 || message != "" {
+		resp["partialSuccess"] = map[string]interface{}{
+			"rejectedLogRecords": strconv.FormatInt(rejected, 10),
+			"errorMessage":       message,
+		}
+	}
+	return json.Marshal(resp)
+}
+
+func hexIDsToBase64(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, val := range x {
+			if s, ok := val.(string); ok && (k == "traceId" || k == "spanId" || k == "trace_id" || k == "span_id") {
+				if b, err := hex.DecodeString(s); err == nil {
+					x[k] = base64.StdEncoding.EncodeToString(b)
+				}
+				continue
+			}
+			hexIDsToBase64(val)
+		}
+	case []interface{}:
+		for _, val := range x {
+			hexIDsToBase64(val)
+		}
+	}
+}
+
+// ToLogs flattens an export request. Records carrying an HTTP status and URL
+// become log entries: the HTTP semantic convention attributes fill the
+// typed fields and everything else lands in Data. Ordinary application
+// records become events, as syslog does for non-access-log messages. The
+// returned entries are not validated.
+func ToLogs(req *logspb.LogsData, source string) ([]models.Log, []models.Event) {
+	var (
+		out    []models.Log
+		events []models.Event
+		now    = time.Now().UTC()
+		n      int
+	)
+	for _, rl := range req.GetResourceLogs() {
+		resource := attrMap(rl.GetResource().GetAttributes())
+		for _, sl := range rl.GetScopeLogs() {
+			scope := sl.GetScope()
+			for _, rec := range sl.GetLogRecords() {
+				attrs := attrMap(rec.GetAttributes())
+				data := map[string]interface{}{}
+
+				var at time.Time
+				ts := rec.GetTimeUnixNano()
+				if ts == 0 {
+					ts = rec.GetObservedTimeUnixNano()
+				}
+				if ts != 0 && ts <= math.MaxInt64 {
+					at = time.Unix(0, int64(ts)).UTC()
+				}
+
+				var traceID string
+				if id := rec.GetTraceId(); len(id) > 0 {
+					traceID = hex.EncodeToString(id)
+					data["trace_id"] = traceID
+				}
+				if id := rec.GetSpanId(); len(id) > 0 {
+					data["span_id"] = hex.EncodeToString(id)
+				}
+				severity := rec.GetSeverityText()
+				if severity == "" && rec.GetSeverityNumber() != 0 {
+					severity = rec.GetSeverityNumber().String()
+				}
+				if severity != "" {
+					data["severity"] = severity
+				}
+				if rec.GetEventName() != "" {
+					data["event"] = rec.GetEventName()
+				}
+				if scope.GetName() != "" {
+					data["scope"] = scope.GetName()
+				}
+				moveHeaders(attrs, data)
+				if len(attrs) > 0 {
+					data["attributes"] = nest(attrs)
+				}
+				if len(resource) > 0 {
+					data["resource"] = nest(resource)
+				}
+				body := anyValue(rec.GetBody())
+
+				status := int(intAttr(attrs, "http.response.status_code", "http.status_code"))
+				path := urlFrom(attrs, resource)
+				if status == 0 || path == "" {
+					delete(data, "severity")
+					if at.IsZero() {
+						at = now
+					}
+					e := models.Event{
+						Timestamp:  at,
+						ReceivedAt: now,
+						Source:     source,
+						Host:       stringAttr(resource, "host.name"),
+						App:        stringAttr(resource, "service.name"),
+						Severity:   severity,
+						Message:    message(body),
+						Structured: data,
+						EventID:    recordID(rec, n),
+					}
+					if _, ok := body.(string); !ok && body != nil {
+						data["body"] = body
+					}
+					events = append(events, e)
+					n++
+					continue
+				}
+
+				l := models.Log{
+					Timestamp: at,
+					Status:    status,
+					Method:    strings.ToUpper(stringAttr(attrs, "http.request.method", "http.method")),
+					Path:      path,
+					Took:      tookFrom(attrs),
+					TraceID:   traceID,
+					ReqID:     recordID(rec, n),
+					Data:      data,
+				}
+				delete(data, "trace_id")
+				if body != nil {
+					data["body"] = body
+				}
+				out = append(out, l)
+				n++
+			}
+		}
+	}
+	return out, events
+}
+
+// recordID derives a req_id from the record and its position in the
+// request: an exporter retrying the same request yields the same ids, so
+// the replay is dropped as duplicates, while records of one span stay
+// distinct.
+func recordID(rec *logspb.LogRecord, n int) string {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(rec)
+	h := sha256.New()
+	h.Write(b)
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(n)))
+	return "otlp-" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// message is the body as event text.
+func message(body interface{}) string {
+	switch x := body.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Sprint(body)
+	}
+	return string(b)
+}
+
+// consumed attributes are mapped onto typed fields and left out of Data.
+var consumed = []string{
+	"http.response.status_code", "http.status_code",
+	"http.request.method", "http.method",
+	"url.full", "http.url", "url.scheme", "http.scheme",
+	"server.address", "http.host", "server.port",
+	"url.path", "http.target", "url.query",
+	"http.server.request.duration", "http.server.duration", "duration_ms",
+}
+
+func attrMap(kvs []*common.KeyValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		m[kv.GetKey()] = anyValue(kv.GetValue())
+	}
+	return m
+}
+
+func anyValue(v *common.AnyValue) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch x := v.GetValue().(type) {
+	case *common.AnyValue_StringValue:
+		return x.StringValue
+	case *common.AnyValue_BoolValue:
+		return x.BoolValue
+	case *common.AnyValue_IntValue:
+		return x.IntValue
+	case *common.AnyValue_DoubleValue:
+		return x.DoubleValue
+	case *common.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(x.BytesValue)
+	case *common.AnyValue_ArrayValue:
+		out := make([]interface{}, 0, len(x.ArrayValue.GetValues()))
+		for _, e := range x.ArrayValue.GetValues() {
+			out = append(out, anyValue(e))
+		}
+		return out
+	case *common.AnyValue_KvlistValue:
+		return attrMap(x.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+func stringAttr(attrs map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := attrs[k]; ok {
+			switch x := v.(type) {
+			case string:
+				return x
+			case int64, float64, bool:
+				return fmt.Sprint(x)
+			}
+		}
+	}
+	return ""
+}
+
+func intAttr(attrs map[string]interface{}, keys ...string) int64 {
+	for _, k := range keys {
+		switch x := attrs[k].(type) {
+		case int64:
+			return x
+		case float64:
+			return int64(x)
+		case string:
+			if n, err := strconv.ParseInt(x, 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+func floatAttr(attrs map[string]interface{}, key string) (float64, bool) {
+	switch x := attrs[key].(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case string:
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// tookFrom returns the request duration in milliseconds. The current
+// convention reports seconds, older instrumentations milliseconds.
+func tookFrom(attrs map[string]interface{}) int {
+	if s, ok := floatAttr(attrs, "http.server.request.duration"); ok {
+		return int(math.Round(s * 1000))
+	}
+	if ms, ok := floatAttr(attrs, "http.server.duration"); ok {
+		return int(math.Round(ms))
+	}
+	if ms, ok := floatAttr(attrs, "duration_ms"); ok {
+		return int(math.Round(ms))
+	}
+	return 0
+}
+
+// urlFrom rebuilds the full request URL in the same scheme://host/uri form
+// the nginx logger sends.
+func urlFrom(attrs, resource map[string]interface{}) string {
+	if full := stringAttr(attrs, "url.full", "http.url"); full != "" {
+		return full
+	}
+
+	path := stringAttr(attrs, "url.path")
+	query := stringAttr(attrs, "url.query")
+	if path == "" {
+		target := stringAttr(attrs, "http.target")
+		if target == "" {
+			return ""
+		}
+		path, query, _ = strings.Cut(target, "?")
+	}
+
+	host := stringAttr(attrs, "server.address", "http.host")
+	if host == "" {
+		return (&url.URL{Path: path, RawQuery: query}).String()
+	}
+	if port := stringAttr(attrs, "server.port"); port != "" && !strings.Contains(host, ":") {
+		host += ":" + port
+	}
+	scheme := stringAttr(attrs, "url.scheme", "http.scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	return (&url.URL{Scheme: scheme, Host: host, Path: path, RawQuery: query}).String()
+}
+
+// moveHeaders takes the http.request.header.* and http.response.header.*
+// attributes out of attrs into data.request.headers and
+// data.response.headers, where the redaction header rules apply.
+func moveHeaders(attrs, data map[string]interface{}) {
+	for _, side := range []string{"request", "response"} {
+		prefix := "http." + side + ".header."
+		headers := map[string]interface{}{}
+		for k, v := range attrs {
+			if name, ok := strings.CutPrefix(k, prefix); ok && name != "" {
+				headers[name] = v
+				delete(attrs, k)
+			}
+		}
+		if len(headers) > 0 {
+			data[side] = map[string]interface{}{"headers": headers}
+		}
+	}
+}
+
+// nest turns dotted attribute names into nested maps, so they can be queried
+// as regular document paths. A name that collides with a scalar keeps its
+// dots replaced by underscores.
+func nest(attrs map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range attrs {
+		if isConsumed(k) {
+			continue
+		}
+		parts := strings.Split(k, ".")
+		m := out
+		ok := true
+		for _, p := range parts[:len(parts)-1] {
+			next, exists := m[p]
+			if !exists {
+				child := map[string]interface{}{}
+				m[p] = child
+				m = child
+				continue
+			}
+			child, isMap := next.(map[string]interface{})
+			if !isMap {
+				ok = false
+				break
+			}
+			m = child
+		}
+		last := parts[len(parts)-1]
+		if _, taken := m[last]; !ok || taken {
+			out[strings.ReplaceAll(k, ".", "_")] = v
+			continue
+		}
+		m[last] = v
+	}
+	return out
+}
+
+func isConsumed(k string) bool {
+	for _, c := range consumed {
+		if c == k {
+			return true
+		}
+	}
+	return false
+}
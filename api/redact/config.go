@@ -0,0 +1,149 @@
+package redact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	ModeDrop = "drop"
+	ModeHash = "hash"
+	ModeMask = "mask"
+)
+
+// Rule matches a header name, a body key or a substring of any captured text
+// and says how the match is masked. For headers Match is a case-insensitive
+// header name, for keys it is a regexp on the key, and for detectors it is
+// one of the built-in detector names or a regexp.
+type Rule struct {
+	Name  string `json:"name,omitempty"`
+	Match string `json:"match"`
+	Mode  string `json:"mode"`
+	Keep  int    `json:"keep,omitempty"`
+}
+
+type Config struct {
+	Salt      string `json:"salt,omitempty"`
+	Headers   []Rule `json:"headers"`
+	Keys      []Rule `json:"keys"`
+	Detectors []Rule `json:"detectors"`
+}
+
+const (
+	DetectorCard  = "card"
+	DetectorEmail = "email"
+	DetectorJWT   = "jwt"
+)
+
+var builtinDetectors = map[string]*regexp.Regexp{
+	DetectorCard:  regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+	DetectorEmail: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	DetectorJWT:   regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`),
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Headers: []Rule{
+			{Match: "authorization", Mode: ModeDrop},
+			{Match: "proxy-authorization", Mode: ModeDrop},
+			{Match: "cookie", Mode: ModeDrop},
+			{Match: "set-cookie", Mode: ModeDrop},
+			{Match: "x-api-key", Mode: ModeHash},
+			{Match: "x-ingest-key", Mode: ModeDrop},
+		},
+		Keys: []Rule{
+			{Name: "password", Match: `(?i)^(password|passwd|pwd|pass)$|password`, Mode: ModeDrop},
+			{Name: "token", Match: `(?i)token`, Mode: ModeHash},
+			{Name: "secret", Match: `(?i)secret|api_?key`, Mode: ModeDrop},
+		},
+		Detectors: []Rule{
+			{Match: DetectorCard, Mode: ModeMask, Keep: 4},
+			{Match: DetectorEmail, Mode: ModeHash},
+			{Match: DetectorJWT, Mode: ModeDrop},
+		},
+	}
+}
+
+// LoadConfig reads a JSON config from path. An empty path yields the
+// defaults.
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+func compile(cfg Config) (*Redactor, error) {
+	r := &Redactor{salt: cfg.Salt, headers: map[string]compiledRule{}}
+
+	for _, rule := range cfg.Headers {
+		if err := checkRule(rule); err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(strings.TrimSpace(rule.Match))
+		if rule.Name == "" {
+			rule.Name = "header:" + name
+		}
+		r.headers[name] = compiledRule{Rule: rule}
+	}
+
+	for _, rule := range cfg.Keys {
+		if err := checkRule(rule); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("key rule %q: %w", rule.Match, err)
+		}
+		if rule.Name == "" {
+			rule.Name = "key:" + rule.Match
+		}
+		r.keys = append(r.keys, compiledRule{Rule: rule, re: re})
+	}
+
+	for _, rule := range cfg.Detectors {
+		if err := checkRule(rule); err != nil {
+			return nil, err
+		}
+		re, ok := builtinDetectors[rule.Match]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(rule.Match); err != nil {
+				return nil, fmt.Errorf("detector %q: %w", rule.Match, err)
+			}
+		}
+		if rule.Name == "" {
+			rule.Name = "detector:" + rule.Match
+		}
+		r.detectors = append(r.detectors, compiledRule{Rule: rule, re: re})
+	}
+	return r, nil
+}
+
+func checkRule(r Rule) error {
+	if strings.TrimSpace(r.Match) == "" {
+		return errors.New("redact rule without match")
+	}
+	switch r.Mode {
+	case ModeDrop, ModeHash, ModeMask:
+		return nil
+	}
+	return fmt.Errorf("redact rule %q: unknown mode %q", r.Match, r.Mode)
+}
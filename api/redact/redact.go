@@ -0,0 +1,351 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"metrics/models"
+)
+
+const dropped = "[redacted]"
+
+// hashed matches the output of ModeHash.
+var hashed = regexp.MustCompile(`^sha256:[0-9a-f]{16}$`)
+
+// Hit records one masked value, for the dry-run endpoint.
+type Hit struct {
+	Rule string `json:"rule"`
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+type Redactor struct {
+	salt      string
+	headers   map[string]compiledRule
+	keys      []compiledRule
+	detectors []compiledRule
+}
+
+var (
+	mu      sync.RWMutex
+	current *Redactor
+)
+
+// Configure compiles cfg and makes it the active rule set.
+func Configure(cfg Config) error {
+	r, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	current = r
+	mu.Unlock()
+	return nil
+}
+
+func active() *Redactor {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Log masks sensitive values in l.Data in place using the active rules.
+func Log(l *models.Log) []Hit {
+	r := active()
+	if r == nil || l.Data == nil {
+		return nil
+	}
+	return r.Log(l)
+}
+
+func (r *Redactor) Log(l *models.Log) []Hit {
+	var hits []Hit
+	r.walkMap(l.Data, "data", false, &hits)
+	return hits
+}
+
+// Event masks sensitive values in e.Structured like Log does in Data, and
+// runs the detectors over the message text.
+func Event(e *models.Event) []Hit {
+	r := active()
+	if r == nil {
+		return nil
+	}
+	var hits []Hit
+	if e.Structured != nil {
+		r.walkMap(e.Structured, "structured", false, &hits)
+	}
+	e.Message = r.detect(e.Message, "message", &hits)
+	return hits
+}
+
+// Payload masks a raw ingestion payload kept outside the logs, such as a
+// dead letter. Every JSON document in it, alone, in an array or one per
+// NDJSON line, is walked like Log walks Data, top-level fields included;
+// text that does not decode only goes through the detectors.
+func Payload(payload string) string {
+	r := active()
+	if r == nil {
+		return payload
+	}
+	if v, ok := decodeJSON(payload); ok {
+		return r.document(payload, v)
+	}
+	lines := strings.Split(payload, "\n")
+	if len(lines) > 1 {
+		decoded := true
+		for i, line := range lines {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			v, ok := decodeJSON(line)
+			if !ok {
+				decoded = false
+				break
+			}
+			lines[i] = r.document(line, v)
+		}
+		if decoded {
+			return strings.Join(lines, "\n")
+		}
+	}
+	var hits []Hit
+	return r.detect(payload, "payload", &hits)
+}
+
+// decodeJSON decodes s keeping numbers as written, so a payload re-encoded
+// after masking still carries its exact timestamps.
+func decodeJSON(s string) (interface{}, bool) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return nil, false
+	}
+	return v, true
+}
+
+// document masks a decoded JSON document and re-encodes it, or returns s
+// when nothing matched.
+func (r *Redactor) document(s string, v interface{}) string {
+	var hits []Hit
+	switch x := v.(type) {
+	case map[string]interface{}:
+		r.walkMap(x, "payload", false, &hits)
+	case []interface{}:
+		r.walkSlice(x, "payload", &hits)
+	case string:
+		v = r.detect(x, "payload", &hits)
+	}
+	if len(hits) == 0 {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return r.detect(s, "payload", &hits)
+	}
+	return string(b)
+}
+
+func (r *Redactor) walkMap(m map[string]interface{}, path string, isHeaders bool, hits *[]Hit) {
+	contentType, _ := m["content_type"].(string)
+
+	for k, v := range m {
+		p := path + "." + k
+
+		if isHeaders {
+			if rule, ok := r.headers[strings.ToLower(k)]; ok {
+				r.applyKey(m, k, v, rule, p, hits)
+				continue
+			}
+		}
+		if rule, ok := r.matchKey(k); ok {
+			r.applyKey(m, k, v, rule, p, hits)
+			continue
+		}
+
+		switch x := v.(type) {
+		case map[string]interface{}:
+			r.walkMap(x, p, k == "headers", hits)
+		case []interface{}:
+			r.walkSlice(x, p, hits)
+		case string:
+			if k == "body" {
+				m[k] = r.body(x, contentType, p, hits)
+			} else {
+				m[k] = r.detect(x, p, hits)
+			}
+		}
+	}
+}
+
+func (r *Redactor) walkSlice(s []interface{}, path string, hits *[]Hit) {
+	for i, v := range s {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			r.walkMap(x, path, false, hits)
+		case []interface{}:
+			r.walkSlice(x, path, hits)
+		case string:
+			s[i] = r.detect(x, path, hits)
+		}
+	}
+}
+
+func (r *Redactor) matchKey(k string) (compiledRule, bool) {
+	for _, rule := range r.keys {
+		if rule.re.MatchString(k) {
+			return rule, true
+		}
+	}
+	return compiledRule{}, false
+}
+
+// applyKey masks the whole value stored under k. Header values arrive either
+// as a string or as a list of strings when the header repeats.
+func (r *Redactor) applyKey(m map[string]interface{}, k string, v interface{}, rule compiledRule, path string, hits *[]Hit) {
+	*hits = append(*hits, Hit{Rule: rule.Name, Path: path, Mode: rule.Mode})
+	if rule.Mode == ModeDrop {
+		delete(m, k)
+		return
+	}
+	switch x := v.(type) {
+	case string:
+		m[k] = r.mask(x, rule.Rule)
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i := range x {
+			out[i] = r.mask(stringify(x[i]), rule.Rule)
+		}
+		m[k] = out
+	default:
+		m[k] = r.mask(stringify(x), rule.Rule)
+	}
+}
+
+// body redacts a captured request or response body. JSON and form bodies are
+// parsed so key rules apply to their fields; everything else only goes
+// through the detectors.
+func (r *Redactor) body(s, contentType, path string, hits *[]Hit) string {
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(trimmed), &v); err == nil {
+			before := len(*hits)
+			switch x := v.(type) {
+			case map[string]interface{}:
+				r.walkMap(x, path, false, hits)
+			case []interface{}:
+				r.walkSlice(x, path, hits)
+			}
+			if len(*hits) == before {
+				return s
+			}
+			if b, err := json.Marshal(v); err == nil {
+				return string(b)
+			}
+		}
+	}
+
+	if strings.Contains(strings.ToLower(contentType), "application/x-www-form-urlencoded") {
+		if vals, err := url.ParseQuery(trimmed); err == nil {
+			before := len(*hits)
+			for k, vs := range vals {
+				rule, ok := r.matchKey(k)
+				if !ok {
+					for i := range vs {
+						vs[i] = r.detect(vs[i], path+"."+k, hits)
+					}
+					continue
+				}
+				*hits = append(*hits, Hit{Rule: rule.Name, Path: path + "." + k, Mode: rule.Mode})
+				if rule.Mode == ModeDrop {
+					vals.Del(k)
+					continue
+				}
+				for i := range vs {
+					vs[i] = r.mask(vs[i], rule.Rule)
+				}
+			}
+			if len(*hits) == before {
+				return s
+			}
+			return vals.Encode()
+		}
+	}
+
+	return r.detect(s, path, hits)
+}
+
+func (r *Redactor) detect(s, path string, hits *[]Hit) string {
+	for _, rule := range r.detectors {
+		s = rule.re.ReplaceAllStringFunc(s, func(m string) string {
+			if rule.Match == DetectorCard && !luhn(m) {
+				return m
+			}
+			*hits = append(*hits, Hit{Rule: rule.Name, Path: path, Mode: rule.Mode})
+			if rule.Mode == ModeDrop {
+				return dropped
+			}
+			return r.mask(m, rule.Rule)
+		})
+	}
+	return s
+}
+
+func (r *Redactor) mask(s string, rule Rule) string {
+	switch rule.Mode {
+	case ModeHash:
+		if hashed.MatchString(s) {
+			// already masked, e.g. a dead letter being resubmitted
+			return s
+		}
+		sum := sha256.Sum256([]byte(r.salt + s))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case ModeMask:
+		keep := rule.Keep
+		runes := []rune(s)
+		if keep < 0 || keep*2 >= len(runes) {
+			keep = 0
+		}
+		return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+	}
+	return dropped
+}
+
+func stringify(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func luhn(s string) bool {
+	var digits []int
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, int(c-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		if (len(digits)-1-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
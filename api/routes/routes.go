@@ -0,0 +1,181 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"metrics/models"
+	"metrics/storage"
+)
+
+// Placeholder replaces automatically detected identifier segments.
+const Placeholder = ":id"
+
+var (
+	uuidSegment     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	objectIDSegment = regexp.MustCompile(`^[0-9a-fA-F]{24}$`)
+	// md5, sha1, sha256 and other long hex tokens
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+)
+
+type template struct {
+	pattern  string
+	host     string
+	segs     []string
+	wildcard bool
+	literals int
+}
+
+// Normalizer maps paths to routes using the configured templates first and
+// identifier detection second.
+type Normalizer struct {
+	templates []template
+}
+
+func New(list []models.RouteTemplate) *Normalizer {
+	n := &Normalizer{}
+	for _, t := range list {
+		ct := template{pattern: t.Pattern, host: strings.ToLower(t.Host)}
+		segs := split(t.Pattern)
+		if len(segs) > 0 && segs[len(segs)-1] == "*" {
+			ct.wildcard = true
+			segs = segs[:len(segs)-1]
+		}
+		for _, s := range segs {
+			if !strings.HasPrefix(s, ":") {
+				ct.literals++
+			}
+		}
+		ct.segs = segs
+		n.templates = append(n.templates, ct)
+	}
+	// most specific first: host-bound, then more literal segments, then
+	// exact length over wildcards
+	sort.SliceStable(n.templates, func(i, j int) bool {
+		a, b := n.templates[i], n.templates[j]
+		if (a.host != "") != (b.host != "") {
+			return a.host != ""
+		}
+		if a.literals != b.literals {
+			return a.literals > b.literals
+		}
+		return !a.wildcard && b.wildcard
+	})
+	return n
+}
+
+// Route returns the route for a decomposed path.
+func (n *Normalizer) Route(host, pathname string) string {
+	segs := split(pathname)
+	for _, t := range n.templates {
+		if t.match(host, segs) {
+			return t.pattern
+		}
+	}
+
+	out := make([]string, len(segs))
+	for i, s := range segs {
+		if isIdentifier(s) {
+			out[i] = Placeholder
+		} else {
+			out[i] = s
+		}
+	}
+	route := "/" + strings.Join(out, "/")
+	if len(segs) > 0 && strings.HasSuffix(pathname, "/") {
+		route += "/"
+	}
+	return route
+}
+
+func (t template) match(host string, segs []string) bool {
+	if t.host != "" && t.host != host {
+		return false
+	}
+	if len(segs) < len(t.segs) || (!t.wildcard && len(segs) != len(t.segs)) {
+		return false
+	}
+	for i, s := range t.segs {
+		if !strings.HasPrefix(s, ":") && s != segs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentifier(s string) bool {
+	return numericSegment.MatchString(s) ||
+		uuidSegment.MatchString(s) ||
+		objectIDSegment.MatchString(s) ||
+		hexSegment.MatchString(s)
+}
+
+func split(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+var (
+	mu      sync.RWMutex
+	current = New(nil)
+)
+
+// Configure makes list the active template set.
+func Configure(list []models.RouteTemplate) {
+	n := New(list)
+	mu.Lock()
+	current = n
+	mu.Unlock()
+}
+
+func active() *Normalizer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Route normalizes with the active templates.
+func Route(host, pathname string) string {
+	return active().Route(host, pathname)
+}
+
+// Load reads the templates from the database and activates them.
+func Load(ctx context.Context) error {
+	list, err := storage.RouteTemplateList(ctx)
+	if err != nil {
+		return err
+	}
+	Configure(list)
+	return nil
+}
+
+// Watch reloads the templates periodically so that changes made through
+// another instance are picked up. It returns when ctx is done.
+func Watch(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			if err := Load(lctx); err != nil {
+				log.Printf("routes: reload: %v", err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package sampling
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"metrics/models"
+)
+
+// Rule keeps Rate of the logs that match every condition it sets. Unset
+// conditions match anything; StatusMax and TookMin are inclusive.
+type Rule struct {
+	Name       string   `json:"name,omitempty"`
+	StatusMin  int      `json:"status_min,omitempty"`
+	StatusMax  int      `json:"status_max,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	Host       string   `json:"host,omitempty"`
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	Route      string   `json:"route,omitempty"`
+	TookMin    int      `json:"took_min,omitempty"`
+	Rate       float64  `json:"rate"`
+}
+
+// Config is evaluated top to bottom and the first matching rule decides;
+// logs matching no rule are kept at DefaultRate. For example
+//
+//	{"rules": [
+//	  {"name": "errors", "status_min": 400, "rate": 1},
+//	  {"name": "slow", "took_min": 1000, "rate": 1},
+//	  {"name": "static", "status_min": 200, "status_max": 299, "path_prefix": "/static", "rate": 0.1}
+//	]}
+type Config struct {
+	DefaultRate *float64 `json:"default_rate,omitempty"`
+	Rules       []Rule   `json:"rules"`
+}
+
+// LoadConfig reads a JSON config from path. An empty path keeps everything.
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return Config{}, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+type Sampler struct {
+	defaultRate float64
+	rules       []Rule
+}
+
+func compile(cfg Config) (*Sampler, error) {
+	s := &Sampler{defaultRate: 1}
+	if cfg.DefaultRate != nil {
+		s.defaultRate = *cfg.DefaultRate
+	}
+	if !validRate(s.defaultRate) {
+		return nil, errors.New("sampling: default_rate must be in [0, 1]")
+	}
+	for _, r := range cfg.Rules {
+		if !validRate(r.Rate) {
+			return nil, errors.New("sampling: rule " + r.Name + ": rate must be in [0, 1]")
+		}
+		for i, m := range r.Methods {
+			r.Methods[i] = strings.ToUpper(m)
+		}
+		r.Host = strings.ToLower(r.Host)
+		s.rules = append(s.rules, r)
+	}
+	return s, nil
+}
+
+func validRate(r float64) bool {
+	return r >= 0 && r <= 1 && !math.IsNaN(r)
+}
+
+var (
+	mu      sync.RWMutex
+	current = &Sampler{defaultRate: 1}
+)
+
+// Configure compiles cfg and makes it the active rule set.
+func Configure(cfg Config) error {
+	s, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	current = s
+	mu.Unlock()
+	return nil
+}
+
+func active() *Sampler {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Keep decides whether l is stored and records the rate on kept entries
+// sampled below 1; such an entry stands for 1/SampleRate requests when
+// counting. The decision is derived from req_id, so a retried entry gets the
+// same answer.
+func Keep(l *models.Log) bool {
+	return active().Keep(l)
+}
+
+func (s *Sampler) Keep(l *models.Log) bool {
+	l.SampleRate = 0
+	rate := s.Rate(l)
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 || bucket(l.ReqID) >= rate {
+		return false
+	}
+	l.SampleRate = rate
+	return true
+}
+
+// Rate returns the rate of the first matching rule.
+func (s *Sampler) Rate(l *models.Log) float64 {
+	for i := range s.rules {
+		if s.rules[i].match(l) {
+			return s.rules[i].Rate
+		}
+	}
+	return s.defaultRate
+}
+
+func (r *Rule) match(l *models.Log) bool {
+	if r.StatusMin != 0 && l.Status < r.StatusMin {
+		return false
+	}
+	if r.StatusMax != 0 && l.Status > r.StatusMax {
+		return false
+	}
+	if r.TookMin != 0 && l.Took < r.TookMin {
+		return false
+	}
+	if r.Host != "" && l.Host != r.Host {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(l.Pathname, r.PathPrefix) {
+		return false
+	}
+	if r.Route != "" && l.Route != r.Route {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		for _, m := range r.Methods {
+			if m == l.Method {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// bucket maps a req_id uniformly onto [0, 1).
+func bucket(reqID string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(reqID))
+	// fnv alone clusters on sequential ids; finish with splitmix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
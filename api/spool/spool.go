@@ -0,0 +1,493 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The spool is a local write-ahead buffer for payloads that could not be
+// written to Mongo. Records are appended as raw BSON documents to segment
+// files; a BSON document starts with its own length, so no extra framing is
+// needed. Closed segments are replayed oldest first and removed once every
+// record in them has been written.
+
+var (
+	ErrDisabled = errors.New("spool_disabled")
+	ErrFull     = errors.New("spool_full")
+	// ErrDropped is wrapped by a replayer refusing a record for good, such
+	// as a document the database rejects; the replay goes on without it.
+	ErrDropped = errors.New("spool_record_dropped")
+)
+
+const (
+	kindLog       = "log"
+	kindSpeedtest = "speedtest"
+	kindEvent     = "event"
+
+	segmentExt = ".seg"
+
+	// Mongo refuses documents over 16 MiB, so anything larger is garbage.
+	maxRecordBytes = 16 << 20
+)
+
+type Config struct {
+	Dir            string
+	MaxBytes       int64
+	SegmentBytes   int64
+	ReplayInterval time.Duration
+	ReplayBatch    int
+}
+
+// Replayer writes spooled payloads back to the database. Implementations must
+// be idempotent: a segment is replayed again from the start if any write in
+// it fails.
+type Replayer struct {
+	Logs      func(ctx context.Context, batch []models.Log) error
+	Speedtest func(ctx context.Context, st *models.Speedtest) error
+	Events    func(ctx context.Context, batch []models.Event) error
+}
+
+type Status struct {
+	Enabled        bool       `json:"enabled"`
+	Dir            string     `json:"dir,omitempty"`
+	Segments       int        `json:"segments"`
+	Bytes          int64      `json:"bytes"`
+	MaxBytes       int64      `json:"maxBytes"`
+	Spooled        int64      `json:"spooled"`
+	Replayed       int64      `json:"replayed"`
+	Rejected       int64      `json:"rejected"`
+	Corrupt        int64      `json:"corrupt"`
+	Dropped        int64      `json:"dropped"`
+	LastReplayAt   *time.Time `json:"lastReplayAt,omitempty"`
+	LastReplayErr  string     `json:"lastReplayError,omitempty"`
+	LastAppendedAt *time.Time `json:"lastAppendedAt,omitempty"`
+}
+
+type record struct {
+	Kind      string            `bson:"kind"`
+	Log       *models.Log       `bson:"log,omitempty"`
+	Speedtest *models.Speedtest `bson:"speedtest,omitempty"`
+	Event     *models.Event     `bson:"event,omitempty"`
+}
+
+type spool struct {
+	cfg      Config
+	replayer Replayer
+
+	mu       sync.Mutex
+	active   *os.File
+	activeSz int64
+	bytes    int64
+	seq      int64
+	status   Status
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var current *spool
+
+// Start opens the spool directory and launches the replayer. It is a no-op
+// when cfg.Dir is empty.
+func Start(cfg Config, r Replayer) error {
+	if cfg.Dir == "" {
+		return nil
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 30
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = 16 << 20
+	}
+	if cfg.ReplayInterval <= 0 {
+		cfg.ReplayInterval = 10 * time.Second
+	}
+	if cfg.ReplayBatch <= 0 {
+		cfg.ReplayBatch = 500
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return err
+	}
+
+	s := &spool{cfg: cfg, replayer: r, done: make(chan struct{})}
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, p := range segs {
+		if fi, err := os.Stat(p); err == nil {
+			s.bytes += fi.Size()
+		}
+	}
+	s.status = Status{Enabled: true, Dir: cfg.Dir, MaxBytes: cfg.MaxBytes}
+
+	s.wg.Add(1)
+	go s.loop()
+	current = s
+	return nil
+}
+
+// Stop halts the replayer and closes the active segment. Spooled data stays
+// on disk for the next start.
+func Stop() {
+	s := current
+	if s == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil {
+		_ = s.active.Close()
+		s.active = nil
+	}
+}
+
+func Enabled() bool {
+	return current != nil
+}
+
+func AppendLogs(batch []models.Log) error {
+	recs := make([]record, len(batch))
+	for i := range batch {
+		recs[i] = record{Kind: kindLog, Log: &batch[i]}
+	}
+	return appendRecords(recs)
+}
+
+func AppendEvents(batch []models.Event) error {
+	recs := make([]record, len(batch))
+	for i := range batch {
+		recs[i] = record{Kind: kindEvent, Event: &batch[i]}
+	}
+	return appendRecords(recs)
+}
+
+func AppendSpeedtest(st *models.Speedtest) error {
+	return appendRecords([]record{{Kind: kindSpeedtest, Speedtest: st}})
+}
+
+func GetStatus() Status {
+	s := current
+	if s == nil {
+		return Status{}
+	}
+	segs, _ := s.segments()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	st.Segments = len(segs)
+	st.Bytes = s.bytes
+	return st
+}
+
+func appendRecords(recs []record) error {
+	s := current
+	if s == nil {
+		return ErrDisabled
+	}
+
+	var buf []byte
+	for i := range recs {
+		b, err := bson.Marshal(recs[i])
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bytes+int64(len(buf)) > s.cfg.MaxBytes {
+		s.status.Rejected += int64(len(recs))
+		return ErrFull
+	}
+	if s.active == nil || s.activeSz >= s.cfg.SegmentBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(buf); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	s.activeSz += int64(len(buf))
+	s.bytes += int64(len(buf))
+	s.status.Spooled += int64(len(recs))
+	s.status.LastAppendedAt = &now
+	return nil
+}
+
+// rotateLocked closes the active segment, making it eligible for replay, and
+// opens a new one.
+func (s *spool) rotateLocked() error {
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+		s.active = nil
+	}
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq, segmentExt)
+	f, err := os.OpenFile(filepath.Join(s.cfg.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.activeSz = 0
+	return nil
+}
+
+// sealActive closes a non-empty active segment so the replayer can pick it
+// up. The next append opens a fresh one.
+func (s *spool) sealActive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil && s.activeSz > 0 {
+		_ = s.active.Close()
+		s.active = nil
+	}
+}
+
+func (s *spool) activeName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return ""
+	}
+	return s.active.Name()
+}
+
+func (s *spool) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), segmentExt) {
+			out = append(out, filepath.Join(s.cfg.Dir, e.Name()))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *spool) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.replay()
+		}
+	}
+}
+
+func (s *spool) replay() {
+	s.sealActive()
+
+	segs, err := s.segments()
+	if err != nil {
+		s.replayed(0, err)
+		return
+	}
+	active := s.activeName()
+	for _, p := range segs {
+		if p == active {
+			continue
+		}
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		n, err := s.replaySegment(p)
+		if err != nil {
+			s.replayed(0, fmt.Errorf("%s: %w", filepath.Base(p), err))
+			return
+		}
+		s.replayed(n, nil)
+	}
+}
+
+func (s *spool) replayed(n int64, err error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Replayed += n
+	s.status.LastReplayAt = &now
+	s.status.LastReplayErr = ""
+	if err != nil {
+		s.status.LastReplayErr = err.Error()
+	}
+}
+
+// replaySegment writes every record of the segment and removes the file on
+// success. A torn record at the end of a segment, left by a crash during an
+// append, is counted as corrupt and skipped.
+func (s *spool) replaySegment(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var (
+		r       = bufio.NewReader(f)
+		batch   = make([]models.Log, 0, s.cfg.ReplayBatch)
+		events  = make([]models.Event, 0, s.cfg.ReplayBatch)
+		written int64
+		corrupt int64
+		dropped int64
+	)
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := s.replayer.Logs(ctx, batch); err != nil {
+				return err
+			}
+			written += int64(len(batch))
+			batch = batch[:0]
+		}
+		if len(events) > 0 {
+			if err := s.replayer.Events(ctx, events); err != nil {
+				return err
+			}
+			written += int64(len(events))
+			events = events[:0]
+		}
+		return nil
+	}
+
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("spool: %s: %v, skipping rest of segment", filepath.Base(path), err)
+			corrupt++
+			break
+		}
+		switch rec.Kind {
+		case kindLog:
+			if rec.Log == nil {
+				corrupt++
+				continue
+			}
+			batch = append(batch, *rec.Log)
+			if len(batch) >= s.cfg.ReplayBatch {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		case kindEvent:
+			if rec.Event == nil {
+				corrupt++
+				continue
+			}
+			events = append(events, *rec.Event)
+			if len(events) >= s.cfg.ReplayBatch {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		case kindSpeedtest:
+			if rec.Speedtest == nil {
+				corrupt++
+				continue
+			}
+			err := s.replayer.Speedtest(ctx, rec.Speedtest)
+			if errors.Is(err, ErrDropped) {
+				log.Printf("spool: %s: dropping speedtest %s: %v", filepath.Base(path), rec.Speedtest.Result.ID, err)
+				dropped++
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			written++
+		default:
+			corrupt++
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	s.bytes -= fi.Size()
+	if s.bytes < 0 {
+		s.bytes = 0
+	}
+	s.status.Corrupt += corrupt
+	s.status.Dropped += dropped
+	s.mu.Unlock()
+
+	return written, nil
+}
+
+func readRecord(r *bufio.Reader) (record, error) {
+	var rec record
+
+	head, err := r.Peek(4)
+	if err == io.EOF && len(head) == 0 {
+		return rec, io.EOF
+	}
+	if err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	size := int(binary.LittleEndian.Uint32(head))
+	if size < 5 || size > maxRecordBytes {
+		return rec, errors.New("invalid record length")
+	}
+
+	doc := make([]byte, size)
+	if _, err := io.ReadFull(r, doc); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	if err := bson.Unmarshal(doc, &rec); err != nil {
+		return rec, err
+	}
+	return rec, nil
+}
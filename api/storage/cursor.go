@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidCursor = errors.New("invalid_cursor")
+
+// Cursor is a position in a listing ordered by (timestamp, _id) descending.
+// Before pages towards newer entries, otherwise towards older ones. _id
+// breaks ties between entries of the same millisecond, so pages stay stable
+// while new entries arrive at the head.
+type Cursor struct {
+	Timestamp time.Time
+	ID        primitive.ObjectID
+	Before    bool
+}
+
+func (c Cursor) Encode() string {
+	dir := "a"
+	if c.Before {
+		dir = "b"
+	}
+	raw := fmt.Sprintf("%s.%d.%s", dir, c.Timestamp.UnixMilli(), c.ID.Hex())
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 3 || (parts[0] != "a" && parts[0] != "b") {
+		return nil, ErrInvalidCursor
+	}
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Timestamp: time.UnixMilli(ms).UTC(), ID: id, Before: parts[0] == "b"}, nil
+}
+
+// Page selects one page of a cursor listing. Without a Cursor it is the
+// newest page.
+type Page struct {
+	Cursor *Cursor
+	Limit  int64
+}
+
+// PageResult carries the encoded cursors of the neighbouring pages; empty
+// when there is nothing to go to.
+type PageResult struct {
+	Next string
+	Prev string
+}
+
+// findPage runs filter as a cursor listing over coll. key returns the
+// (timestamp, _id) of an item.
+func findPage[T any](ctx context.Context, coll *mongo.Collection, filter bson.D, p Page, opts *options.FindOptions, key func(*T) (time.Time, primitive.ObjectID)) ([]T, PageResult, error) {
+	var res PageResult
+
+	order := -1
+	if p.Cursor != nil {
+		cmp := "$lt"
+		if p.Cursor.Before {
+			cmp, order = "$gt", 1
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: cmp, Value: p.Cursor.Timestamp}}}},
+			bson.D{
+				{Key: "timestamp", Value: p.Cursor.Timestamp},
+				{Key: "_id", Value: bson.D{{Key: cmp, Value: p.Cursor.ID}}},
+			},
+		}})
+	}
+
+	if opts == nil {
+		opts = options.Find()
+	}
+	opts.SetSort(bson.D{{Key: "timestamp", Value: order}, {Key: "_id", Value: order}}).SetLimit(p.Limit + 1)
+
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, res, err
+	}
+	defer cur.Close(ctx)
+
+	out := make([]T, 0)
+	for cur.Next(ctx) {
+		var v T
+		if err := cur.Decode(&v); err != nil {
+			return nil, res, err
+		}
+		out = append(out, v)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, res, err
+	}
+
+	more := int64(len(out)) > p.Limit
+	if more {
+		out = out[:p.Limit]
+	}
+	backwards := p.Cursor != nil && p.Cursor.Before
+	if backwards {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+
+	at := func(i int, before bool) string {
+		ts, id := key(&out[i])
+		return Cursor{Timestamp: ts, ID: id, Before: before}.Encode()
+	}
+	switch {
+	case len(out) == 0 && p.Cursor != nil:
+		// nothing past the cursor yet; offer to look the other way from
+		// the same spot, which is how a client polls for new entries
+		flipped := *p.Cursor
+		flipped.Before = !flipped.Before
+		if backwards {
+			res.Next = flipped.Encode()
+		} else {
+			res.Prev = flipped.Encode()
+		}
+	case len(out) == 0:
+	case backwards:
+		res.Next = at(len(out)-1, false)
+		if more {
+			res.Prev = at(0, true)
+		}
+	default:
+		if more {
+			res.Next = at(len(out)-1, false)
+		}
+		res.Prev = at(0, true)
+	}
+	return out, res, nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func DeadLetterInsert(ctx context.Context, d *models.DeadLetter) error {
+	res, err := deadLetters.InsertOne(ctx, d)
+	if err != nil {
+		return err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		d.ID = oid
+	}
+	return nil
+}
+
+// DeadLetterQuery lists dead letters newest first, without payloads. kind
+// and reason are optional.
+func DeadLetterQuery(ctx context.Context, from, to *time.Time, kind, reason string, limit, skip int64) ([]models.DeadLetter, error) {
+	filter := bson.D{}
+	if from != nil || to != nil {
+		r := bson.D{}
+		if from != nil {
+			r = append(r, bson.E{Key: "$gte", Value: *from})
+		}
+		if to != nil {
+			r = append(r, bson.E{Key: "$lte", Value: *to})
+		}
+		filter = append(filter, bson.E{Key: "receivedAt", Value: r})
+	}
+	if kind != "" {
+		filter = append(filter, bson.E{Key: "kind", Value: kind})
+	}
+	if reason != "" {
+		filter = append(filter, bson.E{Key: "reason", Value: reason})
+	}
+
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "receivedAt", Value: -1}}).
+		SetProjection(bson.D{{Key: "payload", Value: 0}})
+	if skip > 0 {
+		findOpts.SetSkip(skip)
+	}
+	if limit >= 0 {
+		findOpts.SetLimit(limit)
+	}
+
+	cur, err := deadLetters.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	out := make([]models.DeadLetter, 0)
+	for cur.Next(ctx) {
+		var d models.DeadLetter
+		if err := cur.Decode(&d); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, cur.Err()
+}
+
+func DeadLetterGet(ctx context.Context, id primitive.ObjectID) (*models.DeadLetter, error) {
+	var d models.DeadLetter
+	if err := deadLetters.FindOne(ctx, bson.M{"_id": id}).Decode(&d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func DeadLetterMarkResubmitted(ctx context.Context, id, by primitive.ObjectID, at time.Time) error {
+	_, err := deadLetters.UpdateByID(ctx, id, bson.M{"$set": bson.M{"resubmittedAt": at, "resubmittedBy": by}})
+	return err
+}
+
+func DeadLetterDelete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := deadLetters.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
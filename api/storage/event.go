@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"metrics/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventInsert stores events unordered; events whose EventID is already
+// stored are reported as duplicates.
+func EventInsert(ctx context.Context, payload []models.Event) (InsertResult, error) {
+	docs := make([]interface{}, len(payload))
+	for i := range payload {
+		docs[i] = payload[i]
+	}
+	return insertUnordered(ctx, events, docs)
+}
+
+func EventQuery(ctx context.Context, from, to *time.Time, limit, skip int64) ([]models.Event, error) {
+	filter := bson.D{}
+	if from != nil || to != nil {
+		r := bson.D{}
+		if from != nil {
+			r = append(r, bson.E{Key: "$gte", Value: *from})
+		}
+		if to != nil {
+			r = append(r, bson.E{Key: "$lte", Value: *to})
+		}
+		filter = append(filter, bson.E{Key: "timestamp", Value: r})
+	}
+
+	findOpts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	if skip > 0 {
+		findOpts.SetSkip(skip)
+	}
+	if limit >= 0 {
+		findOpts.SetLimit(limit)
+	}
+
+	cur, err := events.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	out := make([]models.Event, 0)
+	for cur.Next(ctx) {
+		var e models.Event
+		if err := cur.Decode(&e); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, cur.Err()
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LogExport streams the matching logs oldest first, reading only fields, and
+// hands each raw document to fn. A negative limit exports everything.
+func LogExport(ctx context.Context, from, to *time.Time, f LogFilter, fields []string, limit int64, fn func(bson.Raw) error) error {
+	filter := f.append(timeRange(from, to))
+	return exportEach(ctx, logs, filter, fields, limit, fn)
+}
+
+// SpeedtestExport is LogExport for speedtest results.
+func SpeedtestExport(ctx context.Context, from, to *time.Time, fields []string, limit int64, fn func(bson.Raw) error) error {
+	return exportEach(ctx, speedtests, timeRange(from, to), fields, limit, fn)
+}
+
+func timeRange(from, to *time.Time) bson.D {
+	filter := bson.D{}
+	if from != nil || to != nil {
+		r := bson.D{}
+		if from != nil {
+			r = append(r, bson.E{Key: "$gte", Value: *from})
+		}
+		if to != nil {
+			r = append(r, bson.E{Key: "$lte", Value: *to})
+		}
+		filter = append(filter, bson.E{Key: "timestamp", Value: r})
+	}
+	return filter
+}
+
+func exportEach(ctx context.Context, coll *mongo.Collection, filter bson.D, fields []string, limit int64, fn func(bson.Raw) error) error {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(projection(fields)).
+		SetBatchSize(1000).
+		SetMaxTime(exportMaxTime)
+	if limit >= 0 {
+		opts.SetLimit(limit)
+	}
+
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		if err := fn(cur.Current); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func projection(fields []string) bson.D {
+	return includeFields(bson.D{{Key: "_id", Value: 0}}, fields)
+}
+
+// includeFields adds fields to the projection p, leaving out paths already
+// covered by a parent (Mongo rejects "data" together with "data.user").
+func includeFields(p bson.D, fields []string) bson.D {
+	for _, f := range fields {
+		covered := false
+		for _, g := range fields {
+			if g != f && strings.HasPrefix(f, g+".") {
+				covered = true
+				break
+			}
+		}
+		if !covered && !projected(p, f) {
+			p = append(p, bson.E{Key: f, Value: 1})
+		}
+	}
+	return p
+}
+
+func projected(p bson.D, f string) bool {
+	for _, e := range p {
+		if e.Key == f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GroupSpec describes a grouped aggregation: one row per distinct value of
+// Key with the Metrics, ordered by SortBy descending, cut to Limit. With
+// Other, the rows past the limit are folded into one more row.
+type GroupSpec struct {
+	Key     interface{} // expression, e.g. "$route"
+	Metrics []GroupMetric
+	SortBy  string
+	Limit   int
+	Other   bool
+	// Having filters the grouped rows before sorting, e.g. on a minimum
+	// count.
+	Having bson.D
+}
+
+// GroupMetric is one output field of a GroupSpec row. Acc is its $group
+// accumulator, or nil for a metric derived from others. Expr, evaluated
+// after grouping, finishes or derives the value. In the other row additive
+// metrics are summed and Expr is applied again, so ratios are recomputed;
+// non-additive accumulators such as percentiles come out null.
+type GroupMetric struct {
+	Name     string
+	Acc      interface{}
+	Expr     interface{}
+	Additive bool
+}
+
+// groupPipeline appends the grouping stages to pre. The result is a single
+// document {top: [...], other: [...]}; other holds at most one row, whose
+// "groups" field counts the folded rows.
+func groupPipeline(pre mongo.Pipeline, spec GroupSpec) mongo.Pipeline {
+	group := bson.D{{Key: "_id", Value: spec.Key}}
+	finish := bson.D{}
+	otherGroup := bson.D{{Key: "_id", Value: nil}, {Key: "groups", Value: bson.D{{Key: "$sum", Value: 1}}}}
+	for _, m := range spec.Metrics {
+		if m.Acc != nil {
+			group = append(group, bson.E{Key: m.Name, Value: m.Acc})
+		}
+		if m.Expr != nil {
+			finish = append(finish, bson.E{Key: m.Name, Value: m.Expr})
+		}
+		if m.Additive {
+			otherGroup = append(otherGroup, bson.E{Key: m.Name, Value: bson.D{{Key: "$sum", Value: "$" + m.Name}}})
+		}
+	}
+
+	p := append(mongo.Pipeline{}, pre...)
+	p = append(p, bson.D{{Key: "$group", Value: group}})
+	if len(finish) > 0 {
+		p = append(p, bson.D{{Key: "$set", Value: finish}})
+	}
+	if len(spec.Having) > 0 {
+		p = append(p, bson.D{{Key: "$match", Value: spec.Having}})
+	}
+	p = append(p, bson.D{{Key: "$sort", Value: bson.D{{Key: spec.SortBy, Value: -1}, {Key: "_id", Value: 1}}}})
+
+	facet := bson.D{{Key: "top", Value: bson.A{bson.D{{Key: "$limit", Value: spec.Limit}}}}}
+	if spec.Other {
+		other := bson.A{
+			bson.D{{Key: "$skip", Value: spec.Limit}},
+			bson.D{{Key: "$group", Value: otherGroup}},
+		}
+		if len(finish) > 0 {
+			other = append(other, bson.D{{Key: "$set", Value: finish}})
+		}
+		facet = append(facet, bson.E{Key: "other", Value: other})
+	}
+	return append(p, bson.D{{Key: "$facet", Value: facet}})
+}
+
+// groupRows runs spec over coll after the pre stages and decodes the rows
+// into T, which should map _id and the metric names.
+func groupRows[T any](ctx context.Context, coll *mongo.Collection, pre mongo.Pipeline, spec GroupSpec) (top []T, other *T, err error) {
+	cur, err := coll.Aggregate(ctx, groupPipeline(pre, spec), userAggregate())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cur.Close(ctx)
+
+	var out struct {
+		Top   []T `bson:"top"`
+		Other []T `bson:"other"`
+	}
+	if cur.Next(ctx) {
+		if err := cur.Decode(&out); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return nil, nil, err
+	}
+	if out.Top == nil {
+		out.Top = []T{}
+	}
+	if len(out.Other) > 0 {
+		other = &out.Other[0]
+	}
+	return out.Top, other, nil
+}
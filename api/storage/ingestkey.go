@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"metrics/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func IngestKeyCreate(ctx context.Context, k *models.IngestKey) error {
+	res, err := ingestKeys.InsertOne(ctx, k)
+	if err != nil {
+		return err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		k.ID = oid
+	}
+	return nil
+}
+
+func IngestKeyList(ctx context.Context) ([]models.IngestKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cur, err := ingestKeys.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	out := make([]models.IngestKey, 0)
+	for cur.Next(ctx) {
+		var k models.IngestKey
+		if err := cur.Decode(&k); err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, cur.Err()
+}
+
+func IngestKeyGetByHash(ctx context.Context, hash string) (*models.IngestKey, error) {
+	var k models.IngestKey
+	err := ingestKeys.FindOne(ctx, bson.M{"hash": hash}).Decode(&k)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// IngestKeyRevoke marks the key as revoked. Revoking an already revoked key
+// keeps the original revocation time.
+func IngestKeyRevoke(ctx context.Context, id primitive.ObjectID) (*models.IngestKey, error) {
+	filter := bson.M{"_id": id}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"revokedAt": bson.M{"$ifNull": bson.A{"$revokedAt", time.Now().UTC()}},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var k models.IngestKey
+	if err := ingestKeys.FindOneAndUpdate(ctx, filter, update, opts).Decode(&k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func IngestKeyTouch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	_, err := ingestKeys.UpdateByID(ctx, id, bson.M{"$max": bson.M{"lastUsedAt": at}})
+	return err
+}
@@ -2,28 +2,144 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"metrics/models"
+	"regexp"
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func LogInsert(ctx context.Context, payload []models.Log) error {
-	if len(payload) == 1 {
-		_, err := logs.InsertOne(ctx, payload[0])
-		return err
-	}
+// InsertResult reports per-index outcomes of an unordered bulk insert.
+// Duplicates are entries whose unique key already exists; they are expected
+// when a client replays a batch and are not treated as failures.
+type InsertResult struct {
+	Inserted   int
+	Duplicates []int
+	Failed     map[int]error
+}
+
+func LogInsert(ctx context.Context, payload []models.Log) (InsertResult, error) {
 	docs := make([]interface{}, len(payload))
 	for i := range payload {
 		docs[i] = payload[i]
 	}
-	_, err := logs.InsertMany(ctx, docs)
-	return err
+	return insertUnordered(ctx, logs, docs)
+}
+
+func insertUnordered(ctx context.Context, coll *mongo.Collection, docs []interface{}) (InsertResult, error) {
+	res := InsertResult{Failed: map[int]error{}}
+	if len(docs) == 0 {
+		return res, nil
+	}
+
+	_, err := coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		res.Inserted = len(docs)
+		return res, nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return res, err
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code == duplicateKeyCode {
+			res.Duplicates = append(res.Duplicates, we.Index)
+			continue
+		}
+		res.Failed[we.Index] = we
+	}
+	res.Inserted = len(docs) - len(res.Duplicates) - len(res.Failed)
+	return res, nil
+}
+
+// LogFilter narrows log queries on the decomposed URL fields and a compiled
+// q expression. Empty fields match everything.
+type LogFilter struct {
+	Host       string
+	Scheme     string
+	Pathname   string
+	PathPrefix string
+	Route      string
+	Query      bson.D
+}
+
+func (f LogFilter) append(filter bson.D) bson.D {
+	if f.Host != "" {
+		filter = append(filter, bson.E{Key: "host", Value: f.Host})
+	}
+	if f.Scheme != "" {
+		filter = append(filter, bson.E{Key: "scheme", Value: f.Scheme})
+	}
+	if f.Pathname != "" {
+		filter = append(filter, bson.E{Key: "pathname", Value: f.Pathname})
+	} else if f.PathPrefix != "" {
+		// an anchored, escaped prefix regex can use the pathname index
+		filter = append(filter, bson.E{Key: "pathname", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(f.PathPrefix)}})
+	}
+	if f.Route != "" {
+		filter = append(filter, bson.E{Key: "route", Value: f.Route})
+	}
+	if len(f.Query) > 0 {
+		filter = append(filter, bson.E{Key: "$and", Value: bson.A{f.Query}})
+	}
+	return filter
 }
 
-func LogQuery(ctx context.Context, from, to *time.Time, limit, skip int64) ([]models.Log, error) {
+// LogGroupFields are the dimensions LogStats can group by.
+var LogGroupFields = map[string]bool{
+	"host":     true,
+	"scheme":   true,
+	"pathname": true,
+	"route":    true,
+}
+
+// LogFields are the log fields a list projection may name, besides
+// data.<path>.
+var LogFields = map[string]bool{
+	"req_id":      true,
+	"timestamp":   true,
+	"status":      true,
+	"took":        true,
+	"path":        true,
+	"method":      true,
+	"host":        true,
+	"scheme":      true,
+	"pathname":    true,
+	"query":       true,
+	"route":       true,
+	"sample_rate": true,
+	"parent_id":   true,
+	"trace_id":    true,
+	"source":      true,
+	"data":        true,
+}
+
+// logProjection includes fields, or every field but data when fields is
+// empty; the search text is never returned. req_id and timestamp are always
+// there, and has_data tells the client whether fetching the data is worth it.
+func logProjection(fields []string) bson.D {
+	include := []string{"req_id", "timestamp"}
+	if len(fields) == 0 {
+		for name := range LogFields {
+			if name != "data" {
+				include = append(include, name)
+			}
+		}
+		sort.Strings(include[2:])
+	}
+	p := includeFields(bson.D{}, append(include, fields...))
+	return append(p, bson.E{Key: "has_data", Value: bson.D{{Key: "$eq", Value: bson.A{
+		bson.D{{Key: "$type", Value: "$data"}}, "object",
+	}}}})
+}
+
+func LogQuery(ctx context.Context, from, to *time.Time, limit, skip int64, f LogFilter, fields []string) ([]models.Log, error) {
 	filter := bson.D{}
 	if from != nil || to != nil {
 		r := bson.D{}
@@ -35,8 +151,12 @@ func LogQuery(ctx context.Context, from, to *time.Time, limit, skip int64) ([]mo
 		}
 		filter = append(filter, bson.E{Key: "timestamp", Value: r})
 	}
+	filter = f.append(filter)
 
-	findOpts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetProjection(logProjection(fields)).
+		SetMaxTime(queryMaxTime)
 	if skip > 0 {
 		findOpts.SetSkip(skip)
 	}
@@ -61,7 +181,28 @@ func LogQuery(ctx context.Context, from, to *time.Time, limit, skip int64) ([]mo
 	return out, cur.Err()
 }
 
-func LogLatest(ctx context.Context, from, to *time.Time, limit, skip int64) (*time.Time, error) {
+// LogPage is LogQuery with cursor paging instead of skip.
+func LogPage(ctx context.Context, from, to *time.Time, f LogFilter, fields []string, p Page) ([]models.Log, PageResult, error) {
+	filter := bson.D{}
+	if from != nil || to != nil {
+		r := bson.D{}
+		if from != nil {
+			r = append(r, bson.E{Key: "$gte", Value: *from})
+		}
+		if to != nil {
+			r = append(r, bson.E{Key: "$lte", Value: *to})
+		}
+		filter = append(filter, bson.E{Key: "timestamp", Value: r})
+	}
+	filter = f.append(filter)
+
+	opts := options.Find().SetProjection(logProjection(fields)).SetMaxTime(queryMaxTime)
+	return findPage(ctx, logs, filter, p, opts, func(l *models.Log) (time.Time, primitive.ObjectID) {
+		return l.Timestamp, l.ID
+	})
+}
+
+func LogLatest(ctx context.Context, from, to *time.Time, limit, skip int64, f LogFilter) (*time.Time, error) {
 	match := bson.D{}
 	if from != nil || to != nil {
 		ts := bson.D{}
@@ -73,8 +214,9 @@ func LogLatest(ctx context.Context, from, to *time.Time, limit, skip int64) (*ti
 		}
 		match = append(match, bson.E{Key: "timestamp", Value: ts})
 	}
+	match = f.append(match)
 
-	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetLimit(1)
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetLimit(1).SetMaxTime(queryMaxTime)
 	if skip > 0 {
 		opts.SetSkip(skip)
 	}
@@ -97,80 +239,124 @@ func LogLatest(ctx context.Context, from, to *time.Time, limit, skip int64) (*ti
 	return &doc.Timestamp, nil
 }
 
-func LogStats(ctx context.Context, from, to time.Time) ([]models.LogChartPoint, error) {
+// LogOldest returns the timestamp of the oldest log, or nil when there are
+// none.
+func LogOldest(ctx context.Context) (*time.Time, error) {
+	var doc struct {
+		Timestamp time.Time `bson:"timestamp"`
+	}
+	err := logs.FindOne(ctx, bson.D{}, options.FindOne().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.D{{Key: "timestamp", Value: 1}})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc.Timestamp, nil
+}
+
+// LogStats buckets status classes per interval, with buckets aligned to
+// loc's clock. With groupBy (one of LogGroupFields) every bucket has one
+// point per distinct value. Buckets without logs are filled with zeros.
+// Where the filter allows it the whole minutes and hours of the range are
+// read from the rollups.
+func LogStats(ctx context.Context, from, to time.Time, groupBy string, f LogFilter, iv StatsInterval, loc *time.Location) ([]models.LogChartPoint, error) {
 	from = from.UTC()
 	to = to.UTC()
 
-	match := bson.D{
-		{Key: "timestamp", Value: bson.D{
-			{Key: "$gte", Value: from},
-			{Key: "$lte", Value: to},
-		}},
+	plan, err := planRollups(ctx, from, to, f, groupBy, iv.rollupUnit(from, to, loc))
+	if err != nil {
+		return nil, err
+	}
+	groupID := func(date string) bson.D {
+		id := bson.D{{Key: "date", Value: iv.trunc(date, loc)}}
+		if groupBy != "" {
+			id = append(id, bson.E{Key: "group", Value: "$" + groupBy})
+		}
+		return id
+	}
+
+	var results []models.LogChartPoint
+	if len(plan.raw) > 0 {
+		pipeline := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: f.append(plan.raw.match("timestamp"))}},
+			bson.D{{Key: "$addFields", Value: bson.D{
+				{Key: "statusN", Value: statusNumber},
+				{Key: "weight", Value: sampleWeight},
+			}}},
+			bson.D{{Key: "$group", Value: append(bson.D{{Key: "_id", Value: groupID("$timestamp")}}, statusClassSums...)}},
+		}
+		points, err := chartPoints(ctx, logs, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, points...)
 	}
+	for _, r := range plan.rollups() {
+		group := bson.D{{Key: "_id", Value: groupID("$t")}}
+		for _, class := range statusClasses {
+			group = append(group, bson.E{Key: class, Value: bson.D{{Key: "$sum", Value: "$" + class}}})
+		}
+		pipeline := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: f.append(r.spans.match("t"))}},
+			bson.D{{Key: "$group", Value: group}},
+		}
+		points, err := chartPoints(ctx, r.coll, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, points...)
+	}
+
+	return densify(sumPoints(results), iv, from, to, loc,
+		func(p *models.LogChartPoint) (int64, string) { return p.Date, p.Group },
+		func(date int64, group string) models.LogChartPoint {
+			return models.LogChartPoint{Date: date, Group: group}
+		})
+}
 
-	truncUnit := "hour"
+// statusClasses are the StatusRecord fields, as stored in the rollups.
+var statusClasses = []string{"success", "redirect", "badRequest", "error"}
 
-	pipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: match}},
-		bson.D{{Key: "$addFields", Value: bson.D{
-			{Key: "statusN", Value: bson.D{{Key: "$convert", Value: bson.D{
-				{Key: "input", Value: "$status"},
-				{Key: "to", Value: "int"},
-				{Key: "onError", Value: 0},
-				{Key: "onNull", Value: 0},
-			}}}}},
-		}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: bson.D{
-				{Key: "date", Value: bson.D{
-					{Key: "$dateTrunc", Value: bson.D{
-						{Key: "date", Value: "$timestamp"},
-						{Key: "unit", Value: truncUnit},
-						{Key: "timezone", Value: "UTC"},
-					}},
-				}},
+// statusNumber is the status as an int, 0 when it is not a number.
+var statusNumber = bson.D{{Key: "$convert", Value: bson.D{
+	{Key: "input", Value: "$status"},
+	{Key: "to", Value: "int"},
+	{Key: "onError", Value: 0},
+	{Key: "onNull", Value: 0},
+}}}
+
+// statusClassSums are the $group accumulators of the weighted status
+// classes over documents with statusN and weight set.
+var statusClassSums = func() bson.D {
+	sums := bson.D{}
+	for i, class := range statusClasses {
+		lo := (i + 2) * 100
+		sums = append(sums, bson.E{Key: class, Value: bson.D{{Key: "$sum", Value: bson.D{
+			{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$gte", Value: bson.A{"$statusN", lo}}},
+					bson.D{{Key: "$lte", Value: bson.A{"$statusN", lo + 99}}},
+				}}},
+				"$weight", 0,
 			}},
-			{Key: "success", Value: bson.D{{Key: "$sum", Value: bson.D{
-				{Key: "$cond", Value: bson.A{
-					bson.D{{Key: "$and", Value: bson.A{
-						bson.D{{Key: "$gte", Value: bson.A{"$statusN", 200}}},
-						bson.D{{Key: "$lte", Value: bson.A{"$statusN", 299}}},
-					}}},
-					1, 0,
-				}},
-			}}}},
-			{Key: "redirect", Value: bson.D{{Key: "$sum", Value: bson.D{
-				{Key: "$cond", Value: bson.A{
-					bson.D{{Key: "$and", Value: bson.A{
-						bson.D{{Key: "$gte", Value: bson.A{"$statusN", 300}}},
-						bson.D{{Key: "$lte", Value: bson.A{"$statusN", 399}}},
-					}}},
-					1, 0,
-				}},
-			}}}},
-			{Key: "badRequest", Value: bson.D{{Key: "$sum", Value: bson.D{
-				{Key: "$cond", Value: bson.A{
-					bson.D{{Key: "$and", Value: bson.A{
-						bson.D{{Key: "$gte", Value: bson.A{"$statusN", 400}}},
-						bson.D{{Key: "$lte", Value: bson.A{"$statusN", 499}}},
-					}}},
-					1, 0,
-				}},
-			}}}},
-			{Key: "error", Value: bson.D{{Key: "$sum", Value: bson.D{
-				{Key: "$cond", Value: bson.A{
-					bson.D{{Key: "$and", Value: bson.A{
-						bson.D{{Key: "$gte", Value: bson.A{"$statusN", 500}}},
-						bson.D{{Key: "$lte", Value: bson.A{"$statusN", 599}}},
-					}}},
-					1, 0,
-				}},
-			}}}},
-		}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id.date", Value: 1}}}},
+		}}}})
+	}
+	return sums
+}()
+
+// chartPoints runs a pipeline that groups by {date, group} into the
+// StatusRecord fields, which it rounds.
+func chartPoints(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) ([]models.LogChartPoint, error) {
+	round := bson.D{}
+	for _, class := range statusClasses {
+		round = append(round, bson.E{Key: class, Value: roundLong("$" + class)})
 	}
+	pipeline = append(pipeline, bson.D{{Key: "$set", Value: round}})
 
-	cur, err := logs.Aggregate(ctx, pipeline)
+	cur, err := coll.Aggregate(ctx, pipeline, userAggregate())
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +366,8 @@ func LogStats(ctx context.Context, from, to time.Time) ([]models.LogChartPoint,
 	for cur.Next(ctx) {
 		var agg struct {
 			ID struct {
-				Date time.Time `bson:"date"`
+				Date  time.Time `bson:"date"`
+				Group string    `bson:"group"`
 			} `bson:"_id"`
 			Success    int64 `bson:"success"`
 			Redirect   int64 `bson:"redirect"`
@@ -191,7 +378,8 @@ func LogStats(ctx context.Context, from, to time.Time) ([]models.LogChartPoint,
 			return nil, err
 		}
 		results = append(results, models.LogChartPoint{
-			Date: agg.ID.Date.UnixMilli(),
+			Date:  agg.ID.Date.UnixMilli(),
+			Group: agg.ID.Group,
 			StatusRecord: models.StatusRecord{
 				Success:    agg.Success,
 				Redirect:   agg.Redirect,
@@ -200,19 +388,40 @@ func LogStats(ctx context.Context, from, to time.Time) ([]models.LogChartPoint,
 			},
 		})
 	}
+	return results, cur.Err()
+}
 
-	if err := cur.Err(); err != nil {
-		return nil, err
+// sumPoints merges the points of one bucket and group that came from
+// different sources.
+func sumPoints(points []models.LogChartPoint) []models.LogChartPoint {
+	type bucket struct {
+		date  int64
+		group string
 	}
-
-	if len(results) == 0 {
-		return []models.LogChartPoint{}, nil
+	at := make(map[bucket]int, len(points))
+	out := points[:0]
+	for _, p := range points {
+		k := bucket{p.Date, p.Group}
+		if i, ok := at[k]; ok {
+			out[i].Success += p.Success
+			out[i].Redirect += p.Redirect
+			out[i].BadRequest += p.BadRequest
+			out[i].Error += p.Error
+			continue
+		}
+		at[k] = len(out)
+		out = append(out, p)
 	}
-
-	return results, nil
+	return out
 }
 
-func LogCount(ctx context.Context, from, to *time.Time, limit, skip int64) (int64, error) {
+// LogCounts is the weighted number of logs in [from, to] and of the 5xx
+// responses among them, counted together. Without limit and skip they are
+// summed from the rollups where they cover the range.
+func LogCounts(ctx context.Context, from, to *time.Time, limit, skip int64, f LogFilter) (total, errs int64, err error) {
+	if from != nil && to != nil && limit < 0 && skip <= 0 {
+		return rollupCounts(ctx, *from, *to, f)
+	}
 	filter := bson.D{}
 	if from != nil || to != nil {
 		r := bson.D{}
@@ -224,31 +433,63 @@ func LogCount(ctx context.Context, from, to *time.Time, limit, skip int64) (int6
 		}
 		filter = append(filter, bson.E{Key: "timestamp", Value: r})
 	}
+	filter = f.append(filter)
 
-	countOpts := options.Count()
+	return weightedCounts(ctx, filter, limit, skip)
+}
+
+// sampleWeight is the number of requests a stored log stands for: 1, or
+// 1/sample_rate for entries kept by a sampling rule.
+var sampleWeight = bson.D{{Key: "$divide", Value: bson.A{
+	1, bson.D{{Key: "$ifNull", Value: bson.A{"$sample_rate", 1}}},
+}}}
+
+func roundLong(expr interface{}) bson.D {
+	return bson.D{{Key: "$toLong", Value: bson.D{{Key: "$round", Value: bson.A{expr, 0}}}}}
+}
+
+// weightedCounts is CountDocuments with sampled entries weighted up, along
+// with the weighted count of 5xx responses. limit and skip apply to
+// documents, as they did for the plain count.
+func weightedCounts(ctx context.Context, filter bson.D, limit, skip int64) (total, errs int64, err error) {
+	pipeline := mongo.Pipeline{bson.D{{Key: "$match", Value: filter}}}
 	if skip > 0 {
-		countOpts.SetSkip(skip)
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: skip}})
 	}
 	if limit >= 0 {
-		countOpts.SetLimit(limit)
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
 	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "statusN", Value: statusNumber},
+			{Key: "weight", Value: sampleWeight},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "n", Value: bson.D{{Key: "$sum", Value: "$weight"}}},
+			statusClassSums[len(statusClasses)-1], // error
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "n", Value: roundLong("$n")},
+			{Key: "error", Value: roundLong("$error")},
+		}}},
+	)
 
-	return logs.CountDocuments(ctx, filter, countOpts)
-}
+	cur, err := logs.Aggregate(ctx, pipeline, userAggregate())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cur.Close(ctx)
 
-func LogCountErrors(ctx context.Context, from, to *time.Time) (int64, error) {
-	filter := bson.D{
-		{Key: "status", Value: bson.D{{Key: "$gte", Value: 500}}},
+	if !cur.Next(ctx) {
+		return 0, 0, cur.Err()
 	}
-	if from != nil || to != nil {
-		r := bson.D{}
-		if from != nil {
-			r = append(r, bson.E{Key: "$gte", Value: *from})
-		}
-		if to != nil {
-			r = append(r, bson.E{Key: "$lte", Value: *to})
-		}
-		filter = append(filter, bson.E{Key: "timestamp", Value: r})
+	var doc struct {
+		N     int64 `bson:"n"`
+		Error int64 `bson:"error"`
+	}
+	if err := cur.Decode(&doc); err != nil {
+		return 0, 0, err
 	}
-	return logs.CountDocuments(ctx, filter)
+	return doc.N, doc.Error, nil
 }
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// LogBreakdownFields are the dimensions LogBreakdown can group by.
+var LogBreakdownFields = map[string]bool{
+	"route":    true,
+	"host":     true,
+	"method":   true,
+	"pathname": true,
+	"scheme":   true,
+	"source":   true,
+	"status":   true,
+}
+
+// LogBreakdownSorts are the metrics LogBreakdown can rank by.
+var LogBreakdownSorts = map[string]bool{
+	"count":      true,
+	"error_rate": true,
+	"p95":        true,
+}
+
+// logBreakdownMetrics: count and errors are weighted by sample rate like
+// LogLatency; errors are 500–599 as in the charts. The finishing
+// expressions share one $set, so the ratios read count and errors before
+// rounding.
+var logBreakdownMetrics = []GroupMetric{
+	{Name: "count", Acc: bson.D{{Key: "$sum", Value: "$weight"}}, Expr: roundLong("$count"), Additive: true},
+	{Name: "errors", Acc: statusClassSums[len(statusClasses)-1].Value.(bson.D), Expr: roundLong("$errors"), Additive: true},
+	{Name: "took_sum", Acc: bson.D{{Key: "$sum", Value: bson.D{{Key: "$multiply", Value: bson.A{
+		bson.D{{Key: "$ifNull", Value: bson.A{"$took", 0}}}, "$weight",
+	}}}}}, Additive: true},
+	{Name: "error_rate", Expr: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$gt", Value: bson.A{"$count", 0}}},
+		bson.D{{Key: "$divide", Value: bson.A{"$errors", "$count"}}},
+		0,
+	}}}},
+	{Name: "mean", Expr: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$gt", Value: bson.A{"$count", 0}}},
+		bson.D{{Key: "$divide", Value: bson.A{"$took_sum", "$count"}}},
+		nil,
+	}}}},
+}
+
+// logBreakdownP95 is the weighted p95 of Took. It needs every log ranked
+// within its group, so it is only computed when the rows are sorted by it.
+var logBreakdownP95 = GroupMetric{Name: "p95", Acc: weightedPercentile(0.95)}
+
+// LogBreakdown ranks the values of by (one of LogBreakdownFields) over
+// [from, to] by sortBy, descending. Groups under minCount requests are
+// left out; with other, the groups past limit are folded into one row.
+// Status groups by the exact code. P95 is only set when sorting by it.
+func LogBreakdown(ctx context.Context, from, to *time.Time, f LogFilter, by, sortBy string, limit int, other bool, minCount int64) ([]models.BreakdownRow, *models.BreakdownRow, error) {
+	key := interface{}("$" + by)
+	if by == "status" {
+		key = bson.D{{Key: "$toString", Value: "$status"}}
+	}
+
+	pre := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: f.append(timeRange(from, to))}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "statusN", Value: statusNumber},
+			{Key: "weight", Value: sampleWeight},
+		}}},
+	}
+	metrics := logBreakdownMetrics
+	if sortBy == "p95" {
+		pre = append(pre, weightedRank(key))
+		metrics = append(metrics[:len(metrics):len(metrics)], logBreakdownP95)
+	}
+	spec := GroupSpec{
+		Key:     key,
+		Metrics: metrics,
+		SortBy:  sortBy,
+		Limit:   limit,
+		Other:   other,
+	}
+	if minCount > 0 {
+		spec.Having = bson.D{{Key: "count", Value: bson.D{{Key: "$gte", Value: minCount}}}}
+	}
+
+	return groupRows[models.BreakdownRow](ctx, logs, pre, spec)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	ErrInvalidInterval  = errors.New("invalid_interval")
+	ErrIntervalTooSmall = errors.New("interval_too_small")
+	ErrTooManyGroups    = errors.New("too_many_groups")
+)
+
+// StatsInterval is the width of one LogStats bucket.
+type StatsInterval struct {
+	Name    string
+	Unit    string // $dateTrunc unit
+	BinSize int
+	size    time.Duration
+}
+
+// StatsIntervals lists the supported intervals, finest first.
+var StatsIntervals = []StatsInterval{
+	{"minute", "minute", 1, time.Minute},
+	{"5m", "minute", 5, 5 * time.Minute},
+	{"15m", "minute", 15, 15 * time.Minute},
+	{"hour", "hour", 1, time.Hour},
+	{"day", "day", 1, 24 * time.Hour},
+	{"week", "week", 1, 7 * 24 * time.Hour},
+}
+
+const (
+	// statsAutoPoints is what an automatic interval aims to stay under
+	statsAutoPoints = 300
+	// statsMaxPoints bounds an explicit interval over a wide range
+	statsMaxPoints = 5000
+	// statsMaxGroupPoints bounds buckets × groups of a grouped chart; a
+	// group_by such as pathname can have a value per request
+	statsMaxGroupPoints = 50000
+)
+
+// StatsIntervalFor resolves name over [from, to]. An empty name or "auto"
+// picks the finest interval that keeps the chart under statsAutoPoints
+// buckets.
+func StatsIntervalFor(name string, from, to time.Time) (StatsInterval, error) {
+	width := to.Sub(from)
+	if name == "" || name == "auto" {
+		for _, iv := range StatsIntervals {
+			if width/iv.size < statsAutoPoints {
+				return iv, nil
+			}
+		}
+		return StatsIntervals[len(StatsIntervals)-1], nil
+	}
+	for _, iv := range StatsIntervals {
+		if iv.Name == name {
+			if width/iv.size > statsMaxPoints {
+				return iv, ErrIntervalTooSmall
+			}
+			return iv, nil
+		}
+	}
+	return StatsInterval{}, ErrInvalidInterval
+}
+
+// trunc is the $dateTrunc of the interval as an expression.
+func (iv StatsInterval) trunc(field string, loc *time.Location) bson.D {
+	args := bson.D{
+		{Key: "date", Value: field},
+		{Key: "unit", Value: iv.Unit},
+		{Key: "binSize", Value: iv.BinSize},
+		{Key: "timezone", Value: loc.String()},
+	}
+	if iv.Unit == "week" {
+		args = append(args, bson.E{Key: "startOfWeek", Value: "monday"})
+	}
+	return bson.D{{Key: "$dateTrunc", Value: args}}
+}
+
+// Start returns the bucket t falls into, the way $dateTrunc computes it:
+// days and weeks (from Monday) start at local midnight, shorter buckets on
+// the local clock.
+func (iv StatsInterval) Start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch iv.Unit {
+	case "day", "week":
+		d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		if iv.Unit == "week" {
+			d = d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+		}
+		return d
+	}
+	_, off := t.Zone()
+	local := t.Unix() + int64(off)
+	step := int64(iv.size / time.Second)
+	return time.Unix(local-mod(local, step)-int64(off), 0).In(loc)
+}
+
+// next returns the start of the bucket after the one starting at b.
+func (iv StatsInterval) next(b time.Time, loc *time.Location) time.Time {
+	var n time.Time
+	switch iv.Unit {
+	case "day":
+		n = iv.Start(b.AddDate(0, 0, 1), loc)
+	case "week":
+		n = iv.Start(b.AddDate(0, 0, 7), loc)
+	default:
+		n = iv.Start(b.Add(iv.size), loc)
+	}
+	if !n.After(b) {
+		// around an offset change truncation can land on b again
+		n = b.Add(iv.size)
+	}
+	return n
+}
+
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+// densify adds empty points, made by zero, for the buckets of [from, to]
+// without logs, for every group that has logs somewhere in the range. key
+// returns a point's bucket start and group. It fails with ErrTooManyGroups
+// rather than fill more than statsMaxGroupPoints points.
+func densify[T any](points []T, iv StatsInterval, from, to time.Time, loc *time.Location, key func(*T) (int64, string), zero func(date int64, group string) T) ([]T, error) {
+	type bucket struct {
+		date  int64
+		group string
+	}
+	have := make(map[bucket]bool, len(points))
+	groups := []string{}
+	seen := map[string]bool{}
+	for i := range points {
+		d, g := key(&points[i])
+		have[bucket{d, g}] = true
+		if !seen[g] {
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) == 0 {
+		groups = append(groups, "")
+	}
+	if len(groups) > 1 {
+		buckets := 0
+		for b := iv.Start(from, loc); !b.After(to); b = iv.next(b, loc) {
+			buckets++
+		}
+		if buckets*len(groups) > statsMaxGroupPoints {
+			return nil, ErrTooManyGroups
+		}
+	}
+
+	out := points
+	for b := iv.Start(from, loc); !b.After(to); b = iv.next(b, loc) {
+		for _, g := range groups {
+			if !have[bucket{b.UnixMilli(), g}] {
+				out = append(out, zero(b.UnixMilli(), g))
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		di, gi := key(&out[i])
+		dj, gj := key(&out[j])
+		if di != dj {
+			return di < dj
+		}
+		return gi < gj
+	})
+	return out, nil
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var latencyPercentiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// LatencyEdges are the default histogram bin edges in milliseconds.
+var LatencyEdges = []int64{0, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+func latencyMatch(from, to time.Time, f LogFilter) bson.D {
+	match := bson.D{
+		{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: from.UTC()},
+			{Key: "$lte", Value: to.UTC()},
+		}},
+		{Key: "took", Value: bson.D{{Key: "$type", Value: "number"}}},
+	}
+	return f.append(match)
+}
+
+// LogLatency summarises Took per interval bucket like LogStats. Count, Mean
+// and the percentiles are weighted by sample rate; Max is taken over the
+// stored logs.
+func LogLatency(ctx context.Context, from, to time.Time, groupBy string, f LogFilter, iv StatsInterval, loc *time.Location) ([]models.LatencyPoint, error) {
+	groupID := bson.D{{Key: "date", Value: iv.trunc("$timestamp", loc)}}
+	sort := bson.D{{Key: "_id.date", Value: 1}}
+	if groupBy != "" {
+		groupID = append(groupID, bson.E{Key: "group", Value: "$" + groupBy})
+		sort = append(sort, bson.E{Key: "_id.group", Value: 1})
+	}
+
+	group := bson.D{
+		{Key: "_id", Value: "$bucket"},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: "$weight"}}},
+		{Key: "weighted", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$multiply", Value: bson.A{"$took", "$weight"}}}}}},
+		{Key: "max", Value: bson.D{{Key: "$max", Value: "$took"}}},
+	}
+	p := bson.A{}
+	for i, q := range latencyPercentiles {
+		name := "p" + strconv.Itoa(i)
+		group = append(group, bson.E{Key: name, Value: weightedPercentile(q)})
+		p = append(p, "$"+name)
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: latencyMatch(from, to, f)}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "bucket", Value: groupID},
+			{Key: "weight", Value: sampleWeight},
+		}}},
+		weightedRank("$bucket"),
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "mean", Value: bson.D{{Key: "$divide", Value: bson.A{"$weighted", "$count"}}}},
+			{Key: "count", Value: roundLong("$count")},
+			{Key: "p", Value: p},
+		}}},
+		bson.D{{Key: "$sort", Value: sort}},
+	}
+
+	cur, err := logs.Aggregate(ctx, pipeline, userAggregate())
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	results := []models.LatencyPoint{}
+	for cur.Next(ctx) {
+		var agg struct {
+			ID struct {
+				Date  time.Time `bson:"date"`
+				Group string    `bson:"group"`
+			} `bson:"_id"`
+			Count int64     `bson:"count"`
+			Mean  float64   `bson:"mean"`
+			Max   float64   `bson:"max"`
+			P     []float64 `bson:"p"`
+		}
+		if err := cur.Decode(&agg); err != nil {
+			return nil, err
+		}
+		p := models.LatencyPoint{
+			Date:  agg.ID.Date.UnixMilli(),
+			Group: agg.ID.Group,
+			Count: agg.Count,
+			Mean:  &agg.Mean,
+			Max:   &agg.Max,
+		}
+		if len(agg.P) == 4 {
+			p.P50, p.P90, p.P95, p.P99 = &agg.P[0], &agg.P[1], &agg.P[2], &agg.P[3]
+		}
+		results = append(results, p)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return densify(results, iv, from, to, loc,
+		func(p *models.LatencyPoint) (int64, string) { return p.Date, p.Group },
+		func(date int64, group string) models.LatencyPoint {
+			return models.LatencyPoint{Date: date, Group: group}
+		})
+}
+
+// weightedRank is the stage that sets rank on every log, the weight of the
+// logs of its partition up to it in Took order, and ranked, the weight of
+// the whole partition. Logs without a numeric Took weigh nothing here.
+func weightedRank(partition interface{}) bson.D {
+	weight := bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$isNumber", Value: "$took"}}, "$weight", 0,
+	}}}
+	return bson.D{{Key: "$setWindowFields", Value: bson.D{
+		{Key: "partitionBy", Value: partition},
+		{Key: "sortBy", Value: bson.D{{Key: "took", Value: 1}}},
+		{Key: "output", Value: bson.D{
+			{Key: "rank", Value: bson.D{
+				{Key: "$sum", Value: weight},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{"unbounded", "current"}}}},
+			}},
+			{Key: "ranked", Value: bson.D{
+				{Key: "$sum", Value: weight},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{"unbounded", "unbounded"}}}},
+			}},
+		}},
+	}}}
+}
+
+// weightedPercentile is the $group accumulator of the p percentile of Took
+// weighted by sample rate: the least Took whose rank reaches p of ranked.
+// $percentile cannot weigh its input, so a sampled route would count for
+// the logs kept of it rather than the requests they stand for.
+func weightedPercentile(p float64) bson.D {
+	return bson.D{{Key: "$min", Value: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$isNumber", Value: "$took"}},
+			bson.D{{Key: "$gte", Value: bson.A{"$rank", bson.D{{Key: "$multiply", Value: bson.A{"$ranked", p}}}}}},
+		}}},
+		"$took", nil,
+	}}}}}
+}
+
+// LogLatencyHistogram counts logs per Took bin over the whole range. With
+// the default edges the rollup sketches answer where they can.
+func LogLatencyHistogram(ctx context.Context, from, to time.Time, f LogFilter, edges []int64) (models.LatencyHistogram, error) {
+	h := models.LatencyHistogram{Edges: edges, Counts: make([]int64, len(edges))}
+	add := func(bin int, n int64) {
+		if bin >= 0 && bin < len(h.Counts) {
+			h.Counts[bin] += n
+		}
+	}
+
+	var unit time.Duration
+	if slices.Equal(edges, rollupEdges) {
+		unit = time.Hour
+	}
+	plan, err := planRollups(ctx, from.UTC(), to.UTC(), f, "", unit)
+	if err != nil {
+		return h, err
+	}
+	if len(plan.raw) > 0 {
+		match := f.append(append(plan.raw.match("timestamp"), bson.E{Key: "took", Value: bson.D{{Key: "$type", Value: "number"}}}))
+		err := latencyBins(ctx, match, edges, nil, func(_ time.Time, bin int, n int64) { add(bin, n) })
+		if err != nil {
+			return h, err
+		}
+	}
+	for _, r := range plan.rollups() {
+		if err := rollupBins(ctx, r, f, add); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// LogLatencyHeatmap is LogLatencyHistogram per interval bucket; buckets
+// without logs have all-zero rows.
+func LogLatencyHeatmap(ctx context.Context, from, to time.Time, f LogFilter, edges []int64, iv StatsInterval, loc *time.Location) (models.LatencyHeatmap, error) {
+	rows := map[int64][]int64{}
+	err := latencyBins(ctx, latencyMatch(from, to, f), edges, iv.trunc("$timestamp", loc), func(date time.Time, bin int, n int64) {
+		ms := date.UnixMilli()
+		if rows[ms] == nil {
+			rows[ms] = make([]int64, len(edges))
+		}
+		rows[ms][bin] = n
+	})
+	if err != nil {
+		return models.LatencyHeatmap{}, err
+	}
+
+	hm := models.LatencyHeatmap{Edges: edges, Rows: []models.LatencyHeatmapRow{}}
+	for b := iv.Start(from, loc); !b.After(to); b = iv.next(b, loc) {
+		counts := rows[b.UnixMilli()]
+		if counts == nil {
+			counts = make([]int64, len(edges))
+		}
+		hm.Rows = append(hm.Rows, models.LatencyHeatmapRow{Date: b.UnixMilli(), Counts: counts})
+	}
+	return hm, nil
+}
+
+// latencyBins groups the weighted counts of the logs matching match by Took
+// bin and, when date is set, by that date expression.
+func latencyBins(ctx context.Context, match bson.D, edges []int64, date bson.D, fn func(date time.Time, bin int, n int64)) error {
+	groupID := bson.D{{Key: "bin", Value: latencyBin(edges)}}
+	if date != nil {
+		groupID = append(groupID, bson.E{Key: "date", Value: date})
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: groupID},
+			{Key: "n", Value: bson.D{{Key: "$sum", Value: sampleWeight}}},
+		}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "n", Value: roundLong("$n")}}}},
+	}
+
+	cur, err := logs.Aggregate(ctx, pipeline, userAggregate())
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var agg struct {
+			ID struct {
+				Bin  int       `bson:"bin"`
+				Date time.Time `bson:"date"`
+			} `bson:"_id"`
+			N int64 `bson:"n"`
+		}
+		if err := cur.Decode(&agg); err != nil {
+			return err
+		}
+		if agg.ID.Bin >= 0 && agg.ID.Bin < len(edges) {
+			fn(agg.ID.Date, agg.ID.Bin, agg.N)
+		}
+	}
+	return cur.Err()
+}
+
+// latencyBin is the index of the bin Took falls into, or -1 below edges[0].
+func latencyBin(edges []int64) interface{} {
+	branches := make(bson.A, 0, len(edges))
+	branches = append(branches, bson.D{
+		{Key: "case", Value: bson.D{{Key: "$lt", Value: bson.A{"$took", edges[0]}}}},
+		{Key: "then", Value: -1},
+	})
+	for i := 1; i < len(edges); i++ {
+		branches = append(branches, bson.D{
+			{Key: "case", Value: bson.D{{Key: "$lt", Value: bson.A{"$took", edges[i]}}}},
+			{Key: "then", Value: i - 1},
+		})
+	}
+	return bson.D{{Key: "$switch", Value: bson.D{
+		{Key: "branches", Value: branches},
+		{Key: "default", Value: len(edges) - 1},
+	}}}
+}
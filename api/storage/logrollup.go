@@ -0,0 +1,759 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The rollups hold weighted per-minute and per-hour aggregates of the logs,
+// one document per bucket start t, host, scheme and route:
+//
+//	{t, host, scheme, route, count, success, redirect, badRequest, error,
+//	 took, took_max, bins: {"0": n, ...}}
+//
+// took is the weighted sum of Took and bins counts the logs per
+// rollupEdges bin, a latency sketch that merges across buckets. LogRollup
+// adds every inserted batch, LogRollupRebuild recomputes a range from the
+// logs. The state document records from when on they are complete.
+//
+// An hour is open until rollupLag after its end. Only LogRollup writes the
+// rollups of open hours, with $inc; only a rebuild writes closed ones, and
+// not before twice the lag, so the two never update the same documents.
+// An hour whose rollups may be off, because a write failed, a late log
+// arrived or a rebuild had to wait, is marked dirty in the state
+// collection, {_id: hour, n}; reads take it from the raw logs until
+// LogRollupRepair has rebuilt it.
+
+// rollupEdges are the bins of the rollup latency sketch.
+var rollupEdges = append([]int64(nil), LatencyEdges...)
+
+// rollupGroupFields are the LogGroupFields the rollups keep.
+var rollupGroupFields = map[string]bool{
+	"host":   true,
+	"scheme": true,
+	"route":  true,
+}
+
+const rollupStateID = "logs"
+
+// rollupLag is how long after its end an hour still takes $inc writes; set
+// by Connect.
+var rollupLag time.Duration
+
+// rollupClosed returns the start of the first open hour at now; with twice
+// the lag, of the first hour that cannot be rebuilt yet.
+func rollupClosed(now time.Time, lag time.Duration) time.Time {
+	return now.UTC().Add(-lag).Truncate(time.Hour)
+}
+
+type rollupKey struct {
+	t                   time.Time
+	host, scheme, route string
+}
+
+type rollupSums struct {
+	count, took float64
+	classes     [4]float64 // statusClasses
+	tookMax     int
+	bins        []float64
+}
+
+// LogRollup adds the batch, which must only hold newly inserted logs, to
+// the minute and hour rollups. Logs of closed hours mark them dirty instead.
+func LogRollup(ctx context.Context, batch []models.Log) error {
+	closed := rollupClosed(time.Now(), rollupLag)
+	var open, late []models.Log
+	for i := range batch {
+		if batch[i].Timestamp.UTC().Before(closed) {
+			late = append(late, batch[i])
+		} else {
+			open = append(open, batch[i])
+		}
+	}
+	if err := LogRollupDirty(ctx, late); err != nil {
+		return err
+	}
+	batch = open
+	if len(batch) == 0 {
+		return nil
+	}
+	for _, r := range []struct {
+		coll *mongo.Collection
+		unit time.Duration
+	}{{logRollupsMinute, time.Minute}, {logRollupsHour, time.Hour}} {
+		sums := map[rollupKey]*rollupSums{}
+		order := []rollupKey{}
+		for i := range batch {
+			l := &batch[i]
+			k := rollupKey{l.Timestamp.UTC().Truncate(r.unit), l.Host, l.Scheme, l.Route}
+			s := sums[k]
+			if s == nil {
+				s = &rollupSums{bins: make([]float64, len(rollupEdges))}
+				sums[k] = s
+				order = append(order, k)
+			}
+			w := 1.0
+			if l.SampleRate > 0 {
+				w = 1 / l.SampleRate
+			}
+			s.count += w
+			if c := l.Status/100 - 2; c >= 0 && c < len(s.classes) {
+				s.classes[c] += w
+			}
+			s.took += float64(l.Took) * w
+			if l.Took > s.tookMax {
+				s.tookMax = l.Took
+			}
+			if b := rollupBin(int64(l.Took)); b >= 0 {
+				s.bins[b] += w
+			}
+		}
+
+		writes := make([]mongo.WriteModel, 0, len(order))
+		for _, k := range order {
+			s := sums[k]
+			inc := bson.D{{Key: "count", Value: s.count}, {Key: "took", Value: s.took}}
+			for c, class := range statusClasses {
+				if s.classes[c] != 0 {
+					inc = append(inc, bson.E{Key: class, Value: s.classes[c]})
+				}
+			}
+			for b, n := range s.bins {
+				if n != 0 {
+					inc = append(inc, bson.E{Key: "bins." + strconv.Itoa(b), Value: n})
+				}
+			}
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{
+					{Key: "t", Value: k.t},
+					{Key: "host", Value: k.host},
+					{Key: "scheme", Value: k.scheme},
+					{Key: "route", Value: k.route},
+				}).
+				SetUpdate(bson.D{
+					{Key: "$inc", Value: inc},
+					{Key: "$max", Value: bson.D{{Key: "took_max", Value: s.tookMax}}},
+				}).
+				SetUpsert(true))
+		}
+		if _, err := r.coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogRollupDirty marks the hours of the batch dirty, for logs the rollups
+// may be missing: a failed LogRollup, or duplicates, which can be the
+// replay of a batch stored before its rollup write was lost.
+func LogRollupDirty(ctx context.Context, batch []models.Log) error {
+	hours := map[time.Time]bool{}
+	for i := range batch {
+		hours[batch[i].Timestamp.UTC().Truncate(time.Hour)] = true
+	}
+	list := make([]time.Time, 0, len(hours))
+	for h := range hours {
+		list = append(list, h)
+	}
+	return rollupMarkDirty(ctx, list)
+}
+
+// rollupPending holds the hours whose dirty mark could not be written.
+// They count as dirty here and are written with the next mark or by
+// LogRollupWatch.
+var rollupPending = struct {
+	sync.Mutex
+	hours map[time.Time]bool
+}{hours: map[time.Time]bool{}}
+
+// rollupMarkDirty marks hours dirty, along with any pending ones. n counts
+// the marks, so a repair that started before the last one leaves the hour
+// dirty. Hours it fails to mark stay pending.
+func rollupMarkDirty(ctx context.Context, hours []time.Time) error {
+	rollupPending.Lock()
+	for h := range rollupPending.hours {
+		hours = append(hours, h)
+		delete(rollupPending.hours, h)
+	}
+	rollupPending.Unlock()
+	if len(hours) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, len(hours))
+	for i, h := range hours {
+		writes[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: h}}).
+			SetUpdate(bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: 1}}}}).
+			SetUpsert(true)
+	}
+	_, err := logRollupState.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		rollupPending.Lock()
+		for _, h := range hours {
+			rollupPending.hours[h] = true
+		}
+		rollupPending.Unlock()
+	}
+	return err
+}
+
+// rollupMarkRangeDirty marks every hour of [from, to] dirty.
+func rollupMarkRangeDirty(ctx context.Context, from, to time.Time) error {
+	var hours []time.Time
+	for h := from.UTC().Truncate(time.Hour); !h.After(to.UTC()); h = h.Add(time.Hour) {
+		hours = append(hours, h)
+	}
+	return rollupMarkDirty(ctx, hours)
+}
+
+// rollupDirty lists the dirty hours in [from, to).
+func rollupDirty(ctx context.Context, from, to time.Time) ([]time.Time, error) {
+	cur, err := logRollupState.Find(ctx, bson.D{{Key: "_id", Value: bson.D{
+		{Key: "$gte", Value: from.Truncate(time.Hour)},
+		{Key: "$lt", Value: to},
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Hour time.Time `bson:"_id"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	hours := make([]time.Time, 0, len(docs))
+	seen := map[time.Time]bool{}
+	for _, d := range docs {
+		hours = append(hours, d.Hour.UTC())
+		seen[d.Hour.UTC()] = true
+	}
+	rollupPending.Lock()
+	for h := range rollupPending.hours {
+		if !seen[h] && !h.Before(from.Truncate(time.Hour)) && h.Before(to) {
+			hours = append(hours, h)
+		}
+	}
+	rollupPending.Unlock()
+	return hours, nil
+}
+
+// LogRollupRepair rebuilds the dirty hours that can be rebuilt and clears
+// them, unless they were marked again meanwhile. It returns how many it
+// rebuilt.
+func LogRollupRepair(ctx context.Context) (int, error) {
+	settled := rollupClosed(time.Now(), 2*rollupLag)
+	cur, err := logRollupState.Find(ctx, bson.D{{Key: "_id", Value: bson.D{
+		{Key: "$gte", Value: time.Time{}},
+		{Key: "$lt", Value: settled},
+	}}}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	var docs []struct {
+		Hour time.Time `bson:"_id"`
+		N    int64     `bson:"n"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return 0, err
+	}
+	for i, d := range docs {
+		h := d.Hour.UTC()
+		if err := rollupRebuildSpan(ctx, span{h, h.Add(time.Hour)}); err != nil {
+			return i, err
+		}
+		_, err := logRollupState.DeleteOne(ctx, bson.D{{Key: "_id", Value: d.Hour}, {Key: "n", Value: d.N}})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(docs), nil
+}
+
+// LogRollupWatch writes the pending dirty marks and runs LogRollupRepair
+// every interval until ctx is done.
+func LogRollupWatch(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := rollupMarkDirty(ctx, nil); err != nil {
+				log.Printf("rollups: marking pending hours dirty: %v", err)
+			}
+			if _, err := LogRollupRepair(ctx); err != nil {
+				log.Printf("rollups: repair: %v", err)
+			}
+		}
+	}
+}
+
+// rollupBin is latencyBin over rollupEdges.
+func rollupBin(took int64) int {
+	if took < rollupEdges[0] {
+		return -1
+	}
+	for i := 1; i < len(rollupEdges); i++ {
+		if took < rollupEdges[i] {
+			return i - 1
+		}
+	}
+	return len(rollupEdges) - 1
+}
+
+// LogRollupStart records, on first start, that the rollups are complete
+// from now on, or from the beginning when there are no logs yet.
+func LogRollupStart(ctx context.Context) error {
+	n, err := logs.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return err
+	}
+	from := time.Now().UTC()
+	if n == 0 {
+		from = time.Time{}
+	}
+	_, err = logRollupState.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: rollupStateID}},
+		bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "from", Value: from}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// rollupCoverage returns from when on the rollups are complete; ok is false
+// before the first start.
+func rollupCoverage(ctx context.Context) (from time.Time, ok bool, err error) {
+	var doc struct {
+		From time.Time `bson:"from"`
+	}
+	err = logRollupState.FindOne(ctx, bson.D{{Key: "_id", Value: rollupStateID}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return doc.From, true, nil
+}
+
+// LogRollupRebuild recomputes the rollups of [from, to), widened to whole
+// hours, from the logs, a day at a time; progress is called after each day.
+// Hours too recent to rebuild are marked dirty for LogRollupRepair. When
+// the range reaches the complete part of the rollups, that part is extended
+// back to from.
+func LogRollupRebuild(ctx context.Context, from, to time.Time, progress func(done time.Time)) error {
+	from = from.UTC().Truncate(time.Hour)
+	to = ceilTime(to.UTC(), time.Hour)
+	end := rollupClosed(time.Now(), 2*rollupLag)
+	if end.After(to) {
+		end = to
+	}
+	for a := from; a.Before(end); {
+		b := a.Add(24 * time.Hour)
+		if b.After(end) {
+			b = end
+		}
+		if err := rollupRebuildSpan(ctx, span{a, b}); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(b)
+		}
+		a = b
+	}
+	var later []time.Time
+	for h := maxTime(from, end); h.Before(to); h = h.Add(time.Hour) {
+		later = append(later, h)
+	}
+	if err := rollupMarkDirty(ctx, later); err != nil {
+		return err
+	}
+
+	cov, ok, err := rollupCoverage(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok && !to.Before(time.Now()):
+		// rebuilt up to now before the server ever kept them
+		_, err = logRollupState.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: rollupStateID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "from", Value: from}}}},
+			options.Update().SetUpsert(true))
+	case ok && from.Before(cov) && !to.Before(cov):
+		_, err = logRollupState.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: rollupStateID}},
+			bson.D{{Key: "$min", Value: bson.D{{Key: "from", Value: from}}}})
+	}
+	return err
+}
+
+// rollupRebuildSpan replaces the rollups of s, whole closed hours, with
+// ones computed from the logs.
+func rollupRebuildSpan(ctx context.Context, s span) error {
+	for _, coll := range []*mongo.Collection{logRollupsMinute, logRollupsHour} {
+		if _, err := coll.DeleteMany(ctx, spans{s}.match("t")); err != nil {
+			return err
+		}
+	}
+
+	// minutes from the logs
+	group := bson.D{
+		{Key: "_id", Value: rollupGroupID(bson.D{{Key: "$dateTrunc", Value: bson.D{
+			{Key: "date", Value: "$timestamp"},
+			{Key: "unit", Value: "minute"},
+		}}})},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: "$weight"}}},
+		{Key: "took", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$multiply", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$took", 0}}}, "$weight",
+		}}}}}},
+		{Key: "took_max", Value: bson.D{{Key: "$max", Value: "$took"}}},
+	}
+	group = append(group, statusClassSums...)
+	for i := range rollupEdges {
+		group = append(group, bson.E{Key: "b" + strconv.Itoa(i), Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+			bson.D{{Key: "$eq", Value: bson.A{"$bin", i}}}, "$weight", 0,
+		}}}}}})
+	}
+	err := rollupMerge(ctx, logs, logRollupsMinute, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: spans{s}.match("timestamp")}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "statusN", Value: statusNumber},
+			{Key: "weight", Value: sampleWeight},
+			{Key: "bin", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$isNumber", Value: "$took"}}, latencyBin(rollupEdges), -1,
+			}}}},
+		}}},
+		bson.D{{Key: "$group", Value: group}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// hours from the minutes
+	group = bson.D{
+		{Key: "_id", Value: rollupGroupID(bson.D{{Key: "$dateTrunc", Value: bson.D{
+			{Key: "date", Value: "$t"},
+			{Key: "unit", Value: "hour"},
+		}}})},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		{Key: "took", Value: bson.D{{Key: "$sum", Value: "$took"}}},
+		{Key: "took_max", Value: bson.D{{Key: "$max", Value: "$took_max"}}},
+	}
+	for _, class := range statusClasses {
+		group = append(group, bson.E{Key: class, Value: bson.D{{Key: "$sum", Value: "$" + class}}})
+	}
+	for i := range rollupEdges {
+		group = append(group, bson.E{Key: "b" + strconv.Itoa(i), Value: bson.D{{Key: "$sum", Value: "$bins." + strconv.Itoa(i)}}})
+	}
+	return rollupMerge(ctx, logRollupsMinute, logRollupsHour, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: spans{s}.match("t")}},
+		bson.D{{Key: "$group", Value: group}},
+	})
+}
+
+func rollupGroupID(t bson.D) bson.D {
+	return bson.D{
+		{Key: "t", Value: t},
+		{Key: "host", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$host", ""}}}},
+		{Key: "scheme", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$scheme", ""}}}},
+		{Key: "route", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$route", ""}}}},
+	}
+}
+
+// rollupMerge runs a pipeline grouped by rollupGroupID into the rollup
+// fields and b<i> bins, and merges its output into the rollups in into.
+func rollupMerge(ctx context.Context, coll, into *mongo.Collection, pipeline mongo.Pipeline) error {
+	bins := bson.D{}
+	for i := range rollupEdges {
+		bins = append(bins, bson.E{Key: strconv.Itoa(i), Value: "$b" + strconv.Itoa(i)})
+	}
+	project := bson.D{
+		{Key: "_id", Value: 0},
+		{Key: "t", Value: "$_id.t"},
+		{Key: "host", Value: "$_id.host"},
+		{Key: "scheme", Value: "$_id.scheme"},
+		{Key: "route", Value: "$_id.route"},
+		{Key: "count", Value: 1},
+		{Key: "took", Value: 1},
+		{Key: "took_max", Value: 1},
+	}
+	for _, class := range statusClasses {
+		project = append(project, bson.E{Key: class, Value: 1})
+	}
+	project = append(project, bson.E{Key: "bins", Value: bins})
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$project", Value: project}},
+		bson.D{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: into.Name()},
+			{Key: "on", Value: bson.A{"t", "host", "scheme", "route"}},
+			{Key: "whenMatched", Value: "replace"},
+			{Key: "whenNotMatched", Value: "insert"},
+		}}},
+	)
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cur.Close(ctx)
+}
+
+// ---------------- Reading ----------------
+
+// span is the half-open range [from, to).
+type span struct{ from, to time.Time }
+
+type spans []span
+
+func (s spans) match(field string) bson.D {
+	or := bson.A{}
+	for _, sp := range s {
+		or = append(or, bson.D{{Key: field, Value: bson.D{
+			{Key: "$gte", Value: sp.from},
+			{Key: "$lt", Value: sp.to},
+		}}})
+	}
+	if len(or) == 1 {
+		return or[0].(bson.D)
+	}
+	return bson.D{{Key: "$or", Value: or}}
+}
+
+// rollupPlan splits a range into the parts answered by the raw logs and by
+// the minute and hour rollups.
+type rollupPlan struct {
+	raw, minute, hour spans
+}
+
+type rollupPart struct {
+	coll  *mongo.Collection
+	spans spans
+}
+
+func (p rollupPlan) rollups() []rollupPart {
+	var parts []rollupPart
+	if len(p.minute) > 0 {
+		parts = append(parts, rollupPart{logRollupsMinute, p.minute})
+	}
+	if len(p.hour) > 0 {
+		parts = append(parts, rollupPart{logRollupsHour, p.hour})
+	}
+	return parts
+}
+
+// planRollups splits [from, to]. The rollups answer the whole minutes, or
+// with unit an hour also whole hours, of the part they cover; the edges,
+// dirty hours and everything else fall to the raw logs. A unit of 0, a
+// filter on pathname or q, or a groupBy the rollups do not keep mean raw
+// logs only.
+func planRollups(ctx context.Context, from, to time.Time, f LogFilter, groupBy string, unit time.Duration) (rollupPlan, error) {
+	end := to.Add(time.Millisecond) // timestamps are stored to the millisecond
+	raw := rollupPlan{raw: spans{{from, end}}}
+	if unit == 0 || f.Pathname != "" || f.PathPrefix != "" || len(f.Query) > 0 || (groupBy != "" && !rollupGroupFields[groupBy]) {
+		return raw, nil
+	}
+	cov, ok, err := rollupCoverage(ctx)
+	if err != nil || !ok {
+		return raw, err
+	}
+	dirty, err := rollupDirty(ctx, from, end)
+	if err != nil {
+		return raw, err
+	}
+	return splitRollups(from, end, cov, unit).without(dirty), nil
+}
+
+// without moves the dirty hours from the rollup parts of p to the raw one.
+func (p rollupPlan) without(dirty []time.Time) rollupPlan {
+	for _, h := range dirty {
+		c := span{h, h.Add(time.Hour)}
+		var cut spans
+		p.minute, cut = p.minute.cut(c)
+		p.raw = append(p.raw, cut...)
+		p.hour, cut = p.hour.cut(c)
+		p.raw = append(p.raw, cut...)
+	}
+	return p
+}
+
+// cut removes c from s, returning what is left and what was removed.
+func (s spans) cut(c span) (left, removed spans) {
+	for _, sp := range s {
+		lo, hi := maxTime(sp.from, c.from), minTime(sp.to, c.to)
+		if !lo.Before(hi) {
+			left = append(left, sp)
+			continue
+		}
+		left = append(left, nonEmpty(span{sp.from, lo}, span{hi, sp.to})...)
+		removed = append(removed, span{lo, hi})
+	}
+	return left, removed
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// splitRollups is planRollups over [from, end) with the rollups complete
+// from cov.
+func splitRollups(from, end, cov time.Time, unit time.Duration) rollupPlan {
+	raw := rollupPlan{raw: spans{{from, end}}}
+	start := from
+	if cov.After(start) {
+		start = cov
+	}
+	m0, m1 := ceilTime(start, time.Minute), end.Truncate(time.Minute)
+	if !m0.Before(m1) {
+		return raw
+	}
+
+	var p rollupPlan
+	p.raw = nonEmpty(span{from, m0}, span{m1, end})
+	h0, h1 := ceilTime(m0, time.Hour), m1.Truncate(time.Hour)
+	if unit == time.Hour && h0.Before(h1) {
+		p.minute = nonEmpty(span{m0, h0}, span{h1, m1})
+		p.hour = spans{{h0, h1}}
+	} else {
+		p.minute = spans{{m0, m1}}
+	}
+	return p
+}
+
+func nonEmpty(s ...span) spans {
+	out := spans{}
+	for _, sp := range s {
+		if sp.from.Before(sp.to) {
+			out = append(out, sp)
+		}
+	}
+	return out
+}
+
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	c := t.Truncate(d)
+	if c.Before(t) {
+		c = c.Add(d)
+	}
+	return c
+}
+
+// rollupUnit is the coarsest rollup whose buckets each fall into one
+// bucket of the interval: hours for hourly and longer intervals when loc
+// is a whole number of hours off UTC at both ends of the range, else
+// minutes when it is a whole number of minutes off, else none.
+func (iv StatsInterval) rollupUnit(from, to time.Time, loc *time.Location) time.Duration {
+	aligned := func(d time.Duration) bool {
+		_, a := from.In(loc).Zone()
+		_, b := to.In(loc).Zone()
+		s := int(d / time.Second)
+		return a%s == 0 && b%s == 0
+	}
+	if iv.Unit != "minute" && aligned(time.Hour) {
+		return time.Hour
+	}
+	if aligned(time.Minute) {
+		return time.Minute
+	}
+	return 0
+}
+
+// rollupCounts sums the count and error fields over [from, to] from the
+// rollups and counts the rest of the range in the raw logs.
+func rollupCounts(ctx context.Context, from, to time.Time, f LogFilter) (total, errs int64, err error) {
+	plan, err := planRollups(ctx, from.UTC(), to.UTC(), f, "", time.Hour)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(plan.raw) > 0 {
+		total, errs, err = weightedCounts(ctx, f.append(plan.raw.match("timestamp")), -1, 0)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, r := range plan.rollups() {
+		pipeline := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: f.append(r.spans.match("t"))}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: nil},
+				{Key: "n", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+				{Key: "error", Value: bson.D{{Key: "$sum", Value: "$error"}}},
+			}}},
+			bson.D{{Key: "$project", Value: bson.D{
+				{Key: "n", Value: roundLong("$n")},
+				{Key: "error", Value: roundLong("$error")},
+			}}},
+		}
+		cur, err := r.coll.Aggregate(ctx, pipeline, userAggregate())
+		if err != nil {
+			return 0, 0, err
+		}
+		var docs []struct {
+			N     int64 `bson:"n"`
+			Error int64 `bson:"error"`
+		}
+		if err := cur.All(ctx, &docs); err != nil {
+			return 0, 0, err
+		}
+		for _, d := range docs {
+			total += d.N
+			errs += d.Error
+		}
+	}
+	return total, errs, nil
+}
+
+// rollupBins adds the latency sketches of the rollup part to fn.
+func rollupBins(ctx context.Context, r rollupPart, f LogFilter, fn func(bin int, n int64)) error {
+	group := bson.D{{Key: "_id", Value: nil}}
+	bins := bson.A{}
+	for i := range rollupEdges {
+		b := "b" + strconv.Itoa(i)
+		group = append(group, bson.E{Key: b, Value: bson.D{{Key: "$sum", Value: "$bins." + strconv.Itoa(i)}}})
+		bins = append(bins, roundLong("$"+b))
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: f.append(r.spans.match("t"))}},
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "bins", Value: bins}}}},
+	}
+	cur, err := r.coll.Aggregate(ctx, pipeline, userAggregate())
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		Bins []int64 `bson:"bins"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		for i, n := range d.Bins {
+			fn(i, n)
+		}
+	}
+	return nil
+}
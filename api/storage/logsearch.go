@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LogSearchHit is a log matching a full-text search with its relevance.
+type LogSearchHit struct {
+	models.Log `bson:",inline"`
+	Score      float64 `bson:"score"`
+}
+
+// LogSearch runs a $text search over path and the indexed text of Data
+// within [from, to], best matches first. fields projects as for LogQuery.
+func LogSearch(ctx context.Context, from, to *time.Time, text string, f LogFilter, fields []string, limit, skip int64) ([]LogSearchHit, error) {
+	filter := f.append(timeRange(from, to))
+	filter = append(filter, bson.E{Key: "$text", Value: bson.D{{Key: "$search", Value: text}}})
+
+	// path and the search text are needed for highlighting
+	score := bson.D{{Key: "$meta", Value: "textScore"}}
+	proj := includeFields(logProjection(fields), []string{"path", "search"})
+	opts := options.Find().
+		SetProjection(append(proj, bson.E{Key: "score", Value: score})).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "timestamp", Value: -1}}).
+		SetMaxTime(queryMaxTime)
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+	if limit >= 0 {
+		opts.SetLimit(limit)
+	}
+
+	cur, err := logs.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	out := make([]LogSearchHit, 0)
+	for cur.Next(ctx) {
+		var h LogSearchHit
+		if err := cur.Decode(&h); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, cur.Err()
+}
+
+// LogIndexSearch fills the search text of logs stored before it was
+// indexed, in bulk writes of batchSize. Logs without any text get an empty
+// one so a re-run skips them.
+func LogIndexSearch(ctx context.Context, batchSize int, progress func(done int64)) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	filter := bson.D{{Key: "search", Value: bson.D{{Key: "$exists", Value: false}}}}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "data", Value: 1}}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetBatchSize(int32(batchSize))
+
+	cur, err := logs.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var done int64
+	writes := make([]mongo.WriteModel, 0, batchSize)
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		res, err := logs.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		done += res.ModifiedCount
+		writes = writes[:0]
+		if progress != nil {
+			progress(done)
+		}
+		return nil
+	}
+
+	for cur.Next(ctx) {
+		var doc struct {
+			ID   primitive.ObjectID     `bson:"_id"`
+			Data map[string]interface{} `bson:"data"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return done, err
+		}
+
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: doc.ID}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "search", Value: models.SearchText(doc.Data)}}}}))
+
+		if len(writes) >= batchSize {
+			if err := flush(); err != nil {
+				return done, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return done, err
+	}
+	return done, flush()
+}
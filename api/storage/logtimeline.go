@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func LogGetByReqID(ctx context.Context, reqID string) (*models.Log, error) {
+	var l models.Log
+	if err := logs.FindOne(ctx, bson.M{"req_id": reqID}).Decode(&l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// LogDataByReqID returns just the Data of a log, for list views that leave
+// it out.
+func LogDataByReqID(ctx context.Context, reqID string) (map[string]interface{}, error) {
+	var doc struct {
+		Data map[string]interface{} `bson:"data"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{{Key: "data", Value: 1}})
+	if err := logs.FindOne(ctx, bson.M{"req_id": reqID}, opts).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Data == nil {
+		doc.Data = map[string]interface{}{}
+	}
+	return doc.Data, nil
+}
+
+// timelineRounds bounds how many hops away from the root the timeline
+// follows parent_id links.
+const timelineRounds = 4
+
+// LogTimeline returns the logs correlated with root within window of its
+// timestamp, oldest first: its parent, the logs naming it or any correlated
+// log as parent_id, and the logs sharing its trace_id. Logs stored before
+// parent_id existed are matched on data.request_id and data.parent_id.
+func LogTimeline(ctx context.Context, root *models.Log, window time.Duration, limit int64) ([]models.Log, error) {
+	span := bson.D{
+		{Key: "$gte", Value: root.Timestamp.Add(-window)},
+		{Key: "$lte", Value: root.Timestamp.Add(window)},
+	}
+
+	found := map[string]models.Log{root.ReqID: *root}
+	frontier := []string{root.ReqID}
+	if root.ParentID != "" {
+		frontier = append(frontier, root.ParentID)
+	}
+	traces, queried := map[string]bool{}, map[string]bool{}
+	if root.TraceID != "" {
+		traces[root.TraceID] = true
+	}
+
+	for round := 0; round < timelineRounds && (len(frontier) > 0 || len(traces) > 0); round++ {
+		or := bson.A{}
+		if len(frontier) > 0 {
+			ids := bson.D{{Key: "$in", Value: frontier}}
+			or = append(or,
+				bson.D{{Key: "req_id", Value: ids}},
+				bson.D{{Key: "parent_id", Value: ids}},
+				bson.D{{Key: "data.request_id", Value: ids}},
+				bson.D{{Key: "data.parent_id", Value: ids}},
+			)
+		}
+		if len(traces) > 0 {
+			list := make([]string, 0, len(traces))
+			for t := range traces {
+				list = append(list, t)
+				queried[t] = true
+			}
+			or = append(or, bson.D{{Key: "trace_id", Value: bson.D{{Key: "$in", Value: list}}}})
+			traces = map[string]bool{}
+		}
+
+		filter := bson.D{
+			{Key: "timestamp", Value: span},
+			{Key: "$or", Value: or},
+		}
+		cur, err := logs.Find(ctx, filter, options.Find().SetLimit(limit))
+		if err != nil {
+			return nil, err
+		}
+
+		frontier = frontier[:0]
+		for cur.Next(ctx) {
+			var l models.Log
+			if err := cur.Decode(&l); err != nil {
+				cur.Close(ctx)
+				return nil, err
+			}
+			if _, ok := found[l.ReqID]; ok {
+				continue
+			}
+			found[l.ReqID] = l
+			frontier = append(frontier, l.ReqID)
+			if l.ParentID != "" {
+				if _, ok := found[l.ParentID]; !ok {
+					frontier = append(frontier, l.ParentID)
+				}
+			}
+			if l.TraceID != "" && !queried[l.TraceID] {
+				traces[l.TraceID] = true
+			}
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(found)) >= limit {
+			break
+		}
+	}
+
+	out := make([]models.Log, 0, len(found))
+	for _, l := range found {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Timestamp.Equal(out[j].Timestamp) {
+			return out[i].ReqID < out[j].ReqID
+		}
+		return out[i].Timestamp.Before(out[j].Timestamp)
+	})
+	if int64(len(out)) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LogDecomposePaths sets the URL fields on logs that predate them, in bulk
+// writes of batchSize. progress is called after every write with the running
+// total.
+func LogDecomposePaths(ctx context.Context, batchSize int, progress func(done int64)) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	filter := bson.D{{Key: "pathname", Value: bson.D{{Key: "$exists", Value: false}}}}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "path", Value: 1}}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetBatchSize(int32(batchSize))
+
+	cur, err := logs.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var done int64
+	writes := make([]mongo.WriteModel, 0, batchSize)
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		res, err := logs.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		done += res.ModifiedCount
+		writes = writes[:0]
+		if progress != nil {
+			progress(done)
+		}
+		return nil
+	}
+
+	for cur.Next(ctx) {
+		var doc struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Path string             `bson:"path"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return done, err
+		}
+
+		p := models.SplitURL(doc.Path)
+		set := bson.D{{Key: "pathname", Value: p.Pathname}}
+		if p.Host != "" {
+			set = append(set, bson.E{Key: "host", Value: p.Host})
+		}
+		if p.Scheme != "" {
+			set = append(set, bson.E{Key: "scheme", Value: p.Scheme})
+		}
+		if p.Query != "" {
+			set = append(set, bson.E{Key: "query", Value: p.Query})
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: doc.ID}}).
+			SetUpdate(bson.D{{Key: "$set", Value: set}}))
+
+		if len(writes) >= batchSize {
+			if err := flush(); err != nil {
+				return done, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return done, err
+	}
+	return done, flush()
+}
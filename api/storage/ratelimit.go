@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RateLimitTake refills the shared token bucket key by rate tokens per
+// second up to burst and takes one token when available, in a single
+// atomic update. It returns the tokens left and whether one was taken. The
+// server clock ($$NOW) is used so replicas with skewed clocks agree.
+func RateLimitTake(ctx context.Context, key string, burst int, rate float64, ttl time.Duration) (float64, bool, error) {
+	refilled := bson.D{{Key: "$min", Value: bson.A{
+		burst,
+		bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$tokens", burst}}},
+			bson.D{{Key: "$multiply", Value: bson.A{
+				bson.D{{Key: "$divide", Value: bson.A{
+					bson.D{{Key: "$subtract", Value: bson.A{"$$NOW", bson.D{{Key: "$ifNull", Value: bson.A{"$at", "$$NOW"}}}}}},
+					1000,
+				}}},
+				rate,
+			}}},
+		}}},
+	}}}
+
+	update := bson.A{
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "tokens", Value: refilled},
+			{Key: "at", Value: "$$NOW"},
+		}}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "allowed", Value: bson.D{{Key: "$gte", Value: bson.A{"$tokens", 1}}}},
+		}}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "tokens", Value: bson.D{{Key: "$cond", Value: bson.A{"$allowed", bson.D{{Key: "$subtract", Value: bson.A{"$tokens", 1}}}, "$tokens"}}}},
+			{Key: "expiresAt", Value: bson.D{{Key: "$add", Value: bson.A{"$$NOW", ttl.Milliseconds()}}}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var doc struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	if err := rateLimits.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&doc); err != nil {
+		return 0, false, err
+	}
+	return doc.Tokens, doc.Allowed, nil
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"metrics/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func RouteTemplateCreate(ctx context.Context, t *models.RouteTemplate) error {
+	res, err := routes.InsertOne(ctx, t)
+	if err != nil {
+		return err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		t.ID = oid
+	}
+	return nil
+}
+
+func RouteTemplateList(ctx context.Context) ([]models.RouteTemplate, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cur, err := routes.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	out := make([]models.RouteTemplate, 0)
+	for cur.Next(ctx) {
+		var t models.RouteTemplate
+		if err := cur.Decode(&t); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, cur.Err()
+}
+
+func RouteTemplateDelete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := routes.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// RenormalizeResult counts the logs scanned and rewritten by LogRenormalize.
+type RenormalizeResult struct {
+	Matched  int64 `json:"matched"`
+	Modified int64 `json:"modified"`
+}
+
+// LogRenormalize recomputes the route of every log in [from, to] with route
+// and writes back the ones that changed, then rebuilds the rollups of the
+// range. Logs stored before URL decomposition get their pathname from the
+// raw path. When it stops after writing, the range is marked dirty so
+// LogRollupRepair rebuilds it.
+func LogRenormalize(ctx context.Context, from, to time.Time, route func(host, pathname string) string) (res RenormalizeResult, err error) {
+	const batchSize = 1000
+
+	wrote := false
+	defer func() {
+		if err == nil || !wrote {
+			return
+		}
+		// ctx may be what stopped it
+		mctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if merr := rollupMarkRangeDirty(mctx, from, to); merr != nil {
+			log.Printf("renormalize: marking rollups dirty: %v", merr)
+		}
+	}()
+
+	filter := bson.D{{Key: "timestamp", Value: bson.D{
+		{Key: "$gte", Value: from},
+		{Key: "$lte", Value: to},
+	}}}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "path", Value: 1}, {Key: "host", Value: 1}, {Key: "pathname", Value: 1}, {Key: "route", Value: 1}}).
+		SetBatchSize(batchSize)
+
+	cur, err := logs.Find(ctx, filter, opts)
+	if err != nil {
+		return res, err
+	}
+	defer cur.Close(ctx)
+
+	writes := make([]mongo.WriteModel, 0, batchSize)
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		wrote = true
+		r, err := logs.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		res.Modified += r.ModifiedCount
+		writes = writes[:0]
+		return nil
+	}
+
+	for cur.Next(ctx) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Path     string             `bson:"path"`
+			Host     string             `bson:"host"`
+			Pathname string             `bson:"pathname"`
+			Route    string             `bson:"route"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return res, err
+		}
+		res.Matched++
+
+		host, pathname := doc.Host, doc.Pathname
+		if pathname == "" {
+			p := models.SplitURL(doc.Path)
+			host, pathname = p.Host, p.Pathname
+		}
+		r := route(host, pathname)
+		if r == doc.Route {
+			continue
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: doc.ID}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "route", Value: r}}}}))
+
+		if len(writes) >= batchSize {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return res, err
+	}
+	if err := flush(); err != nil {
+		return res, err
+	}
+	if res.Modified > 0 {
+		// the rollups are kept per route
+		return res, LogRollupRebuild(ctx, from, to, nil)
+	}
+	return res, nil
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -14,6 +16,16 @@ func SpeedtestInsert(ctx context.Context, st *models.Speedtest) error {
 	return err
 }
 
+// SpeedtestInsertIdempotent inserts the result unless one with the same
+// result.id is already stored.
+func SpeedtestInsertIdempotent(ctx context.Context, st *models.Speedtest) error {
+	err := SpeedtestInsert(ctx, st)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
 func SpeedtestQuery(ctx context.Context, from, to *time.Time) ([]models.Speedtest, error) {
 	filter := bson.D{}
 	if from != nil || to != nil {
@@ -44,6 +56,25 @@ func SpeedtestQuery(ctx context.Context, from, to *time.Time) ([]models.Speedtes
 	return out, cur.Err()
 }
 
+// SpeedtestPage lists results newest first with cursor paging.
+func SpeedtestPage(ctx context.Context, from, to *time.Time, p Page) ([]models.Speedtest, PageResult, error) {
+	filter := bson.D{}
+	if from != nil || to != nil {
+		r := bson.D{}
+		if from != nil {
+			r = append(r, bson.E{Key: "$gte", Value: *from})
+		}
+		if to != nil {
+			r = append(r, bson.E{Key: "$lte", Value: *to})
+		}
+		filter = append(filter, bson.E{Key: "timestamp", Value: r})
+	}
+
+	return findPage(ctx, speedtests, filter, p, nil, func(s *models.Speedtest) (time.Time, primitive.ObjectID) {
+		return s.Timestamp, s.ID
+	})
+}
+
 func SpeedtestCount(ctx context.Context, from, to *time.Time) (int64, error) {
 	filter := bson.D{}
 	if from != nil || to != nil {
@@ -2,13 +2,19 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"os"
+	"time"
+
+	"metrics/utils"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const duplicateKeyCode = 11000
+
 var (
 	client      *mongo.Client
 	db          *mongo.Database
@@ -16,8 +22,29 @@ var (
 	speedtests  *mongo.Collection
 	users       *mongo.Collection
 	logs        *mongo.Collection
+	ingestKeys  *mongo.Collection
+	events      *mongo.Collection
+	routes      *mongo.Collection
+	rateLimits  *mongo.Collection
+	deadLetters *mongo.Collection
+
+	logRollupsMinute *mongo.Collection
+	logRollupsHour   *mongo.Collection
+	logRollupState   *mongo.Collection
+
+	// queryMaxTime bounds the server time of reads over user filters, which
+	// a q expression can make unindexed; exports get exportMaxTime.
+	queryMaxTime  time.Duration
+	exportMaxTime time.Duration
 )
 
+// Refused reports whether err is the database rejecting the document itself,
+// which a retry would not change, rather than a failure to reach it.
+func Refused(err error) bool {
+	var we mongo.WriteException
+	return errors.As(err, &we) && len(we.WriteErrors) > 0 && we.WriteConcernError == nil
+}
+
 func Connect(ctx context.Context) error {
 	uri := os.Getenv("MONGO_URI")
 	if uri == "" {
@@ -37,6 +64,17 @@ func Connect(ctx context.Context) error {
 	speedtests = db.Collection("speedtests")
 	users = db.Collection("users")
 	logs = db.Collection("logs")
+	ingestKeys = db.Collection("ingest_keys")
+	events = db.Collection("events")
+	routes = db.Collection("route_templates")
+	rateLimits = db.Collection("rate_limits")
+	deadLetters = db.Collection("dead_letters")
+	logRollupsMinute = db.Collection("log_rollups_minute")
+	logRollupsHour = db.Collection("log_rollups_hour")
+	logRollupState = db.Collection("log_rollup_state")
+	queryMaxTime = utils.EnvDuration("LOG_QUERY_MAX_TIME", 30*time.Second)
+	exportMaxTime = utils.EnvDuration("LOG_EXPORT_MAX_TIME", 10*time.Minute)
+	rollupLag = utils.EnvDuration("ROLLUP_LAG", 10*time.Minute)
 	return nil
 }
 
@@ -72,11 +110,131 @@ func EnsureIndexes(ctx context.Context) error {
 		{Keys: bson.D{{Key: "status", Value: 1}}, Options: options.Index()},
 		{Keys: bson.D{{Key: "timestamp", Value: 1}}, Options: options.Index()},
 		{Keys: bson.D{{Key: "timestamp", Value: 1}, {Key: "status", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "host", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "pathname", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "route", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "method", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "timestamp", Value: 1}, {Key: "took", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "host", Value: 1}, {Key: "status", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "parent_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "trace_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+		// full-text search; "none" keeps words as written, so error codes
+		// and identifiers are not stemmed or dropped as stop words
+		{Keys: bson.D{{Key: "path", Value: "text"}, {Key: "search", Value: "text"}}, Options: options.Index().
+			SetName("log_text").
+			SetWeights(bson.D{{Key: "path", Value: 2}, {Key: "search", Value: 1}}).
+			SetDefaultLanguage("none")},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// log rollups; the unique key lets concurrent upserts and $merge meet
+	// on one document per bucket
+	for _, coll := range []*mongo.Collection{logRollupsMinute, logRollupsHour} {
+		_, err = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "t", Value: 1}, {Key: "host", Value: 1}, {Key: "scheme", Value: 1}, {Key: "route", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "route", Value: 1}, {Key: "t", Value: 1}}, Options: options.Index()},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// ingest keys
+	_, err = ingestKeys.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// events
+	_, err = events.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: 1}}, Options: options.Index()},
+		{Keys: bson.D{{Key: "host", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index()},
+		// events from before event ids, and sources without one, have none
+		{Keys: bson.D{{Key: "event_id", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "event_id", Value: bson.D{{Key: "$type", Value: "string"}}}})},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// route templates
+	_, err = routes.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "host", Value: 1}, {Key: "pattern", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// shared rate-limit buckets expire once they would be full again
+	_, err = rateLimits.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// dead letters expire after DEADLETTER_RETENTION
+	retention := int32(utils.EnvDuration("DEADLETTER_RETENTION", 14*24*time.Hour).Seconds())
+	if err := retainFor(ctx, deadLetters, "receivedAt", retention); err != nil {
+		return err
+	}
+	_, err = deadLetters.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "receivedAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(retention)},
+		{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "receivedAt", Value: -1}}, Options: options.Index()},
 	})
 
 	return err
 }
 
+// retainFor moves an existing TTL index on field to the given expiry with
+// collMod; creating it again with other options fails with
+// IndexOptionsConflict.
+func retainFor(ctx context.Context, coll *mongo.Collection, field string, seconds int32) error {
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var specs []struct {
+		Key                bson.D `bson:"key"`
+		ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+	}
+	if err := cur.All(ctx, &specs); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if len(spec.Key) != 1 || spec.Key[0].Key != field || spec.ExpireAfterSeconds == nil {
+			continue
+		}
+		if *spec.ExpireAfterSeconds == seconds {
+			return nil
+		}
+		return db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: coll.Name()},
+			{Key: "index", Value: bson.D{
+				{Key: "keyPattern", Value: bson.D{{Key: field, Value: 1}}},
+				{Key: "expireAfterSeconds", Value: seconds},
+			}},
+		}).Err()
+	}
+	return nil
+}
+
+// userAggregate is the options of an aggregation over user filters.
+func userAggregate() *options.AggregateOptions {
+	return options.Aggregate().SetMaxTime(queryMaxTime)
+}
+
 func optionsFind() *options.FindOptions {
 	o := options.Find()
 	o.SetSort(bson.D{{Key: "timestamp", Value: -1}})
@@ -0,0 +1,281 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"metrics/accesslog"
+	"metrics/ingest"
+	"metrics/models"
+)
+
+const (
+	source        = "syslog"
+	maxMessage    = 64 << 10
+	flushSize     = 200
+	flushInterval = time.Second
+)
+
+type Config struct {
+	UDPAddr string
+	TCPAddr string
+}
+
+type server struct {
+	udp net.PacketConn
+	tcp net.Listener
+
+	mu     sync.Mutex
+	logs   []models.Log
+	events []models.Event
+	seq    uint64 // messages received, for event ids
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var current *server
+
+// Start opens the configured listeners. Either address may be empty; with
+// both empty the listener stays off.
+func Start(cfg Config) error {
+	if cfg.UDPAddr == "" && cfg.TCPAddr == "" {
+		return nil
+	}
+
+	s := &server{done: make(chan struct{})}
+	if cfg.UDPAddr != "" {
+		pc, err := net.ListenPacket("udp", cfg.UDPAddr)
+		if err != nil {
+			return err
+		}
+		s.udp = pc
+		s.wg.Add(1)
+		go s.serveUDP()
+		log.Printf("syslog: listening udp %s", cfg.UDPAddr)
+	}
+	if cfg.TCPAddr != "" {
+		ln, err := net.Listen("tcp", cfg.TCPAddr)
+		if err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return err
+		}
+		s.tcp = ln
+		s.wg.Add(1)
+		go s.serveTCP()
+		log.Printf("syslog: listening tcp %s", cfg.TCPAddr)
+	}
+
+	s.wg.Add(1)
+	go s.flusher()
+	current = s
+	return nil
+}
+
+// Stop closes the listeners and writes out whatever is still buffered.
+func Stop() {
+	s := current
+	if s == nil {
+		return
+	}
+	close(s.done)
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.wg.Wait()
+	s.flush()
+}
+
+func (s *server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxMessage)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.handle(string(buf[:n]))
+	}
+}
+
+func (s *server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads RFC 6587 frames: octet-counted ("LEN SP MSG") when the
+// frame starts with a digit, newline-terminated otherwise.
+func (s *server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-s.done:
+		case <-closed:
+		}
+		conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, maxMessage)
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] >= '0' && first[0] <= '9' {
+			lenStr, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(lenStr))
+			if err != nil || n <= 0 || n > maxMessage {
+				return
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			s.handle(string(msg))
+			continue
+		}
+		line, err := r.ReadString('\n')
+		if len(strings.TrimSpace(line)) > 0 {
+			s.handle(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle turns access-log payloads into HTTP logs and keeps everything else
+// as a generic event.
+func (s *server) handle(raw string) {
+	now := time.Now().UTC()
+	msg, err := Parse(raw, now)
+	if err != nil {
+		msg = Message{Timestamp: now, Severity: 6, Text: strings.TrimSpace(raw)}
+	}
+
+	if l, err := accesslog.Combined.Parse(msg.Text); err == nil {
+		l.EnsureReqID()
+		l.Source = source
+		l.Data["host"] = msg.Host
+		l.Data["app_name"] = msg.App
+		l.Data["severity"] = msg.SeverityName()
+		if l.Validate() == nil {
+			s.push(&l, nil)
+			return
+		}
+	}
+
+	s.push(nil, &models.Event{
+		EventID:    s.eventID(raw, now),
+		Timestamp:  msg.Timestamp,
+		ReceivedAt: now,
+		Source:     source,
+		Host:       msg.Host,
+		App:        msg.App,
+		ProcID:     msg.ProcID,
+		MsgID:      msg.MsgID,
+		Facility:   msg.Facility,
+		Severity:   msg.SeverityName(),
+		Message:    msg.Text,
+		Structured: msg.Structured,
+	})
+}
+
+// eventID identifies a received message, so a spooled event replayed twice
+// is stored once; seq tells identical messages apart.
+func (s *server) eventID(raw string, at time.Time) string {
+	s.mu.Lock()
+	s.seq++
+	n := s.seq
+	s.mu.Unlock()
+	h := sha256.New()
+	h.Write([]byte(raw))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(at.UnixNano(), 10) + "/" + strconv.FormatUint(n, 10)))
+	return "syslog-" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func (s *server) push(l *models.Log, e *models.Event) {
+	s.mu.Lock()
+	if l != nil {
+		s.logs = append(s.logs, *l)
+	}
+	if e != nil {
+		s.events = append(s.events, *e)
+	}
+	full := len(s.logs)+len(s.events) >= flushSize
+	s.mu.Unlock()
+
+	if full {
+		s.flush()
+	}
+}
+
+func (s *server) flusher() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *server) flush() {
+	s.mu.Lock()
+	logs, events := s.logs, s.events
+	s.logs, s.events = nil, nil
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if len(logs) > 0 {
+		if err := ingest.Submit(ctx, logs); err != nil {
+			log.Printf("syslog: dropping %d logs: %v", len(logs), err)
+		}
+	}
+	if len(events) > 0 {
+		if err := ingest.StoreEvents(ctx, events); err != nil {
+			log.Printf("syslog: dropping %d events: %v", len(events), err)
+		}
+	}
+}
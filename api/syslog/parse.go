@@ -0,0 +1,189 @@
+package syslog
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+type Message struct {
+	Timestamp  time.Time
+	Facility   int
+	Severity   int
+	Host       string
+	App        string
+	ProcID     string
+	MsgID      string
+	Structured map[string]interface{}
+	Text       string
+}
+
+func (m *Message) SeverityName() string {
+	if m.Severity >= 0 && m.Severity < len(severities) {
+		return severities[m.Severity]
+	}
+	return strconv.Itoa(m.Severity)
+}
+
+var errInvalid = errors.New("invalid syslog message")
+
+// Parse accepts RFC 5424 messages and the legacy BSD format of RFC 3164.
+// Legacy timestamps carry no year or zone; they are read as UTC in the year
+// that puts them closest to now.
+func Parse(raw string, now time.Time) (Message, error) {
+	raw = strings.TrimRight(raw, "\r\n\x00")
+	if !strings.HasPrefix(raw, "<") {
+		return Message{}, errInvalid
+	}
+	end := strings.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return Message{}, errInvalid
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri > 191 {
+		return Message{}, errInvalid
+	}
+
+	m := Message{Facility: pri / 8, Severity: pri % 8, Timestamp: now.UTC()}
+	rest := raw[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		if err := parse5424(&m, rest[2:]); err == nil {
+			return m, nil
+		}
+	}
+	parse3164(&m, rest, now)
+	return m, nil
+}
+
+func parse5424(m *Message, s string) error {
+	fields := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		f, rest, ok := strings.Cut(s, " ")
+		if !ok {
+			return errInvalid
+		}
+		fields = append(fields, f)
+		s = rest
+	}
+
+	if fields[0] != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return errInvalid
+		}
+		m.Timestamp = ts.UTC()
+	}
+	m.Host = nilValue(fields[1])
+	m.App = nilValue(fields[2])
+	m.ProcID = nilValue(fields[3])
+	m.MsgID = nilValue(fields[4])
+
+	if strings.HasPrefix(s, "-") {
+		s = strings.TrimPrefix(s[1:], " ")
+	} else if strings.HasPrefix(s, "[") {
+		sd, rest, err := parseStructured(s)
+		if err != nil {
+			return err
+		}
+		m.Structured = sd
+		s = strings.TrimPrefix(rest, " ")
+	} else {
+		return errInvalid
+	}
+
+	m.Text = strings.TrimPrefix(s, "\ufeff")
+	return nil
+}
+
+// parseStructured reads consecutive SD-ELEMENTs. Each becomes a map of its
+// params keyed by SD-ID.
+func parseStructured(s string) (map[string]interface{}, string, error) {
+	out := map[string]interface{}{}
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd <= 0 {
+			return nil, "", errInvalid
+		}
+		id := s[:idEnd]
+		s = s[idEnd:]
+		params := map[string]interface{}{}
+		for {
+			s = strings.TrimLeft(s, " ")
+			if strings.HasPrefix(s, "]") {
+				s = s[1:]
+				break
+			}
+			eq := strings.Index(s, `="`)
+			if eq <= 0 {
+				return nil, "", errInvalid
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var val strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				c := s[i]
+				if c == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					val.WriteByte(s[i+1])
+					i++
+					continue
+				}
+				if c == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				}
+				val.WriteByte(c)
+			}
+			if !closed {
+				return nil, "", errInvalid
+			}
+			params[name] = val.String()
+		}
+		out[id] = params
+	}
+	return out, s, nil
+}
+
+func parse3164(m *Message, s string, now time.Time) {
+	if len(s) >= len(time.Stamp) {
+		if ts, err := time.Parse(time.Stamp, s[:len(time.Stamp)]); err == nil {
+			ts = ts.AddDate(now.UTC().Year(), 0, 0)
+			if ts.Sub(now) > 24*time.Hour {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = ts.UTC()
+			s = strings.TrimLeft(s[len(time.Stamp):], " ")
+
+			// The hostname is optional; a token ending in ':' or containing
+			// '[' is already the tag.
+			if host, rest, ok := strings.Cut(s, " "); ok && !strings.HasSuffix(host, ":") && !strings.Contains(host, "[") {
+				m.Host = host
+				s = rest
+			}
+		}
+	}
+
+	if i := strings.Index(s, ": "); i > 0 && i <= 48 && !strings.ContainsAny(s[:i], " ") {
+		tag := s[:i]
+		if b := strings.IndexByte(tag, '['); b > 0 && strings.HasSuffix(tag, "]") {
+			m.ProcID = tag[b+1 : len(tag)-1]
+			tag = tag[:b]
+		}
+		m.App = tag
+		s = s[i+2:]
+	}
+	m.Text = s
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
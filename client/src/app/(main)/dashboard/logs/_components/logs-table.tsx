@@ -1,4 +1,5 @@
 'use client'
+import { useState } from 'react';
 import { Log } from '@/types/models/log'
 import { Icon } from '@impactium/icons';
 import s from './logs-table.module.css';
@@ -73,16 +74,7 @@ export function LogsTable({ logs }: LogsTable.Props) {
               <Icon className='mr-2 shrink-0' name={getIcon(log)} color={status === 'error' ? 'var(--red-900)' : 'var(--gray-900)'} />
               <span className={`text-[var(--${status === 'error' ? 'red' : 'gray'}-1000)]! font-mono`}>{domain}</span>
               <span className='truncate font-mono'>{path}</span>
-              {log.data && (
-                <Popover>
-                  <PopoverTrigger asChild>
-                    <Button variant='link' size='icon-sm' className='h-3.5 w-3.5 rounded-[4] cursor-pointer ml-auto'><Icon className='size-3.5' name='Braces' /></Button>
-                  </PopoverTrigger>
-                  <PopoverContent>
-                    {JSON.stringify(log.data, null, 2)}
-                  </PopoverContent>
-                </Popover>
-              )}
+              {(log.data || log.has_data) && <LogData log={log} />}
             </div>
           </div>
         )
@@ -90,3 +82,32 @@ export function LogsTable({ logs }: LogsTable.Props) {
     </Card>
   )
 }
+
+// LogData shows the captured data of a log. Lists leave it out, so it is
+// fetched the first time the popover opens.
+function LogData({ log }: { log: Log.Type }) {
+  const [data, setData] = useState<Log.Type['data']>(log.data);
+
+  const load = (open: boolean) => {
+    if (!open || data) {
+      return;
+    }
+
+    fetch(`/api/logs/${encodeURIComponent(log.req_id)}/data`, {
+      credentials: 'include'
+    })
+    .then((res) => res.ok ? res.json().then(p => setData(p.data)) : null)
+    .catch(() => null);
+  }
+
+  return (
+    <Popover onOpenChange={load}>
+      <PopoverTrigger asChild>
+        <Button variant='link' size='icon-sm' className='h-3.5 w-3.5 rounded-[4] cursor-pointer ml-auto'><Icon className='size-3.5' name='Braces' /></Button>
+      </PopoverTrigger>
+      <PopoverContent>
+        {data ? JSON.stringify(data, null, 2) : '…'}
+      </PopoverContent>
+    </Popover>
+  )
+}
@@ -7,6 +7,7 @@ export namespace Log {
     path: string;
     method: string
     data?: Record<string, any> // optional additional data
+    has_data?: boolean // set on list results, which leave data out
   }
 
   export namespace Statistics {
@@ -91,7 +91,11 @@ function _M.log()
   local _, _ = httpc:request_uri(METRICS_URL, {
     method  = "POST",
     body    = payload,
-    headers = { ["Content-Type"] = "application/json", ["Accept"] = "*/*" },
+    headers = {
+      ["Content-Type"] = "application/json",
+      ["Accept"]       = "*/*",
+      ["X-Ingest-Key"] = ngx.var.metrics_ingest_key,
+    },
     keepalive = false,
   })
 end